@@ -0,0 +1,159 @@
+// binary.go
+//
+// Helpers for moving binary values between Redis and HTTP clients, without
+// mangling them along the way.
+//
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"unicode/utf8"
+)
+
+const (
+	EncodingUTF8   = "utf-8"
+	EncodingBase64 = "base64"
+	EncodingBinary = "binary"
+)
+
+// Returns the value a write operation should store.
+//
+// If the request body is "application/octet-stream", the body itself is the
+// value, byte for byte. Otherwise, the "value" parameter is used; when the
+// request also carries "encoding=base64", the parameter is decoded first.
+//
+func RequestValue(req *http.Request) (value string, err error) {
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if ct == "application/octet-stream" {
+		var body []byte
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return
+		}
+		value = string(body)
+		return
+	}
+
+	value = req.FormValue("value")
+	if req.FormValue("encoding") == EncodingBase64 {
+		var b []byte
+		if b, err = base64.StdEncoding.DecodeString(value); err != nil {
+			err = fmt.Errorf("Could not decode base64 value: %s", err)
+			return
+		}
+		value = string(b)
+	}
+	return
+}
+
+// Like RequestValue, but returns every "value" parameter the request carries,
+// for requests that write several values at once.
+//
+func RequestValues(req *http.Request) (values []string, err error) {
+	req.ParseForm()
+	for _, value := range req.Form["value"] {
+		if req.FormValue("encoding") == EncodingBase64 {
+			var b []byte
+			if b, err = base64.StdEncoding.DecodeString(value); err != nil {
+				err = fmt.Errorf("Could not decode base64 value: %s", err)
+				return
+			}
+			value = string(b)
+		}
+		values = append(values, value)
+	}
+	return
+}
+
+// Makes sure the values in a response's result survive being encoded in the
+// given format, and records how they were encoded in the response's
+// "encoding" field (and the X-Scarlet-Encoding header).
+//
+// Values are sent as they are, unless the client asked for
+// "encoding=base64", or one of them is not valid UTF-8, in which case every
+// value (and hash field name) is base64-encoded. MessagePack can carry bytes
+// natively, so there, invalid UTF-8 values are sent as "bin" instead.
+//
+func EncodeResult(rw http.ResponseWriter, req *http.Request, format string, response R) {
+	result := response["result"]
+	switch result.(type) {
+	case string, []string, map[string]string:
+	default:
+		return
+	}
+
+	encoding := EncodingUTF8
+	if req.FormValue("encoding") == EncodingBase64 {
+		encoding = EncodingBase64
+	} else if !validUTF8(result) {
+		encoding = EncodingBase64
+		if format == FormatMsgpack {
+			encoding = EncodingBinary
+		}
+	}
+
+	response["result"] = encodeValues(result, encoding)
+	response["encoding"] = encoding
+	rw.Header().Set("X-Scarlet-Encoding", encoding)
+	return
+}
+
+func validUTF8(result interface{}) (valid bool) {
+	switch r := result.(type) {
+	case string:
+		return utf8.ValidString(r)
+	case []string:
+		for _, s := range r {
+			if !utf8.ValidString(s) {
+				return false
+			}
+		}
+	case map[string]string:
+		for k, v := range r {
+			if !utf8.ValidString(k) || !utf8.ValidString(v) {
+				return false
+			}
+		}
+	}
+	valid = true
+	return
+}
+
+func encodeValues(result interface{}, encoding string) interface{} {
+	if encoding == EncodingUTF8 {
+		return result
+	}
+
+	encode := func(s string) interface{} {
+		if encoding == EncodingBinary {
+			return []byte(s)
+		}
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	switch r := result.(type) {
+	case string:
+		return encode(r)
+
+	case []string:
+		encoded := make([]interface{}, len(r))
+		for i, s := range r {
+			encoded[i] = encode(s)
+		}
+		return encoded
+
+	case map[string]string:
+		encoded := make(map[string]interface{}, len(r))
+		for k, v := range r {
+			if encoding == EncodingBase64 {
+				k = base64.StdEncoding.EncodeToString([]byte(k))
+			}
+			encoded[k] = encode(v)
+		}
+		return encoded
+	}
+	return result
+}
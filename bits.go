@@ -0,0 +1,414 @@
+// bits.go
+//
+// HyperLogLogs and bitmaps, which Redis stores as strings, but which mean
+// nothing to clients read back as bytes.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Operations["pfadd"] = Operation{Methods: []string{"POST"}, Handler: HandlePFAdd}
+	Operations["pfcount"] = Operation{Methods: []string{"GET"}, Handler: HandlePFCount}
+	Operations["pfmerge"] = Operation{Methods: []string{"POST"}, Handler: HandlePFMerge}
+	Operations["setbit"] = Operation{Methods: []string{"POST"}, Handler: HandleSetBit}
+	Operations["getbit"] = Operation{Methods: []string{"GET"}, Handler: HandleGetBit}
+	Operations["bitcount"] = Operation{Methods: []string{"GET"}, Handler: HandleBitCount}
+	Operations["bitpos"] = Operation{Methods: []string{"GET"}, Handler: HandleBitPos}
+	Operations["bitop"] = Operation{Methods: []string{"POST"}, Handler: HandleBitOp}
+	Operations["bitfield"] = Operation{Methods: []string{"GET", "POST"}, Handler: HandleBitField}
+	return
+}
+
+// HyperLogLogs are strings starting with this magic.
+//
+const HLLMagic = "HYLL"
+
+// The length of a HyperLogLog's header: the magic, the encoding (0 for
+// dense, 1 for sparse), three unused bytes and the cached cardinality.
+//
+const HLLHeaderSize = 16
+
+// Reports whether a string looks like a HyperLogLog, going by its header.
+//
+func IsHyperLogLog(s string) bool {
+	return len(s) >= HLLHeaderSize && strings.HasPrefix(s, HLLMagic) && s[4] <= 1
+}
+
+// Reads the cardinality of a HyperLogLog; used by the read path for strings
+// that turn out to hold one.
+//
+func ReadHyperLogLog(client redis.Conn, key string) (response R) {
+	println("PFCOUNT", key)
+	n, err := redis.Int64(client.Do("PFCOUNT", key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "type": "hyperloglog", "error": nil}
+	return
+}
+
+// Parses an integer parameter; def is used if it wasn't given, unless it is
+// required.
+//
+func intParam(req *http.Request, name string, def int64, required bool) (n int64, response R) {
+	v := req.FormValue(name)
+	if len(v) == 0 && !required {
+		n = def
+		return
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		e := fmt.Sprintf("The %q parameter must be an integer.", name)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+func intResponse(reply interface{}, err error) (response R) {
+	n, err := redis.Int64(reply, err)
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
+
+// Handles POST /{db}/{key}/pfadd, adding the "value" parameters (or a JSON
+// array) to a HyperLogLog. The result says whether its cardinality estimate
+// changed.
+//
+func HandlePFAdd(req *http.Request, info *RequestInfo) (response R) {
+	elements, response := RequestElements(req, "set")
+	if response != nil {
+		return
+	}
+	if len(elements) == 0 {
+		response = R{"result": nil, "error": "No value provided."}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("PFADD", info.Key, len(elements), "elements")
+	changed, err := redis.Bool(client.Do("PFADD", append([]interface{}{info.Key}, elements...)...))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": changed, "error": nil}
+	return
+}
+
+// Handles GET /{db}/{key}/pfcount, estimating the number of unique elements
+// in a HyperLogLog, or in the union of it and the ones named with "key".
+//
+func HandlePFCount(req *http.Request, info *RequestInfo) (response R) {
+	req.ParseForm()
+	keys := append([]string{info.Key}, req.Form["key"]...)
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("PFCOUNT", strings.Join(keys, " "))
+	response = intResponse(client.Do("PFCOUNT", redis.Args{}.AddFlat(keys)...))
+	return
+}
+
+// Handles POST /{db}/{key}/pfmerge, merging the HyperLogLogs named with
+// "key" into this one.
+//
+func HandlePFMerge(req *http.Request, info *RequestInfo) (response R) {
+	req.ParseForm()
+	sources := req.Form["key"]
+	if len(sources) == 0 {
+		e := "Missing required parameter: key."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("PFMERGE", info.Key, strings.Join(sources, " "))
+	if _, err = client.Do("PFMERGE", redis.Args{}.Add(info.Key).AddFlat(sources)...); err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": true, "error": nil}
+	return
+}
+
+// Handles POST /{db}/{key}/setbit?offset={n}&bit={0|1}, returning the bit's
+// old value.
+//
+func HandleSetBit(req *http.Request, info *RequestInfo) (response R) {
+	offset, response := intParam(req, "offset", 0, true)
+	if response != nil {
+		return
+	}
+	bit := req.FormValue("bit")
+	if bit != "0" && bit != "1" {
+		e := "The \"bit\" parameter must be 0 or 1."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("SETBIT", info.Key, offset, bit)
+	response = intResponse(client.Do("SETBIT", info.Key, offset, bit))
+	return
+}
+
+// Handles GET /{db}/{key}/getbit?offset={n}.
+//
+func HandleGetBit(req *http.Request, info *RequestInfo) (response R) {
+	offset, response := intParam(req, "offset", 0, true)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("GETBIT", info.Key, offset)
+	response = intResponse(client.Do("GETBIT", info.Key, offset))
+	return
+}
+
+// Returns the "start" and "end" range arguments, and the "unit" (byte or
+// bit; bit ranges need Redis 7.0), if a range was given.
+//
+func bitRange(req *http.Request) (args redis.Args, response R) {
+	if len(req.FormValue("start")) == 0 {
+		return
+	}
+	start, response := intParam(req, "start", 0, true)
+	if response != nil {
+		return
+	}
+	end, response := intParam(req, "end", -1, false)
+	if response != nil {
+		return
+	}
+	args = args.Add(start, end)
+	switch unit := strings.ToUpper(req.FormValue("unit")); unit {
+	case "":
+	case "BYTE", "BIT":
+		args = args.Add(unit)
+	default:
+		e := "The \"unit\" parameter must be byte or bit."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+// Handles GET /{db}/{key}/bitcount, counting the set bits, optionally
+// between "start" and "end".
+//
+func HandleBitCount(req *http.Request, info *RequestInfo) (response R) {
+	rng, response := bitRange(req)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("BITCOUNT", info.Key)
+	response = intResponse(client.Do("BITCOUNT", append(redis.Args{}.Add(info.Key), rng...)...))
+	return
+}
+
+// Handles GET /{db}/{key}/bitpos?bit={0|1}, finding the first bit set to 1
+// (or 0), optionally between "start" and "end". -1 means there is none.
+//
+func HandleBitPos(req *http.Request, info *RequestInfo) (response R) {
+	bit := req.FormValue("bit")
+	if len(bit) == 0 {
+		bit = "1"
+	}
+	if bit != "0" && bit != "1" {
+		e := "The \"bit\" parameter must be 0 or 1."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	rng, response := bitRange(req)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("BITPOS", info.Key, bit)
+	response = intResponse(client.Do("BITPOS", append(redis.Args{}.Add(info.Key, bit), rng...)...))
+	return
+}
+
+// Handles POST /{db}/{key}/bitop?op={and|or|xor|not}&key={src}..., storing
+// the result of the operation over the source keys in this key. The result
+// is the length of the stored string.
+//
+func HandleBitOp(req *http.Request, info *RequestInfo) (response R) {
+	op := strings.ToUpper(req.FormValue("op"))
+	switch op {
+	case "AND", "OR", "XOR", "NOT":
+	default:
+		e := "The \"op\" parameter must be one of and, or, xor or not."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	req.ParseForm()
+	sources := req.Form["key"]
+	if len(sources) == 0 || (op == "NOT" && len(sources) != 1) {
+		e := "Give the source keys with \"key\" (exactly one, for not)."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("BITOP", op, info.Key, strings.Join(sources, " "))
+	response = intResponse(client.Do("BITOP", redis.Args{}.Add(op, info.Key).AddFlat(sources)...))
+	return
+}
+
+// A single BITFIELD subcommand.
+//
+type BitFieldOperation struct {
+	Op        string      `json:"op"`
+	Type      string      `json:"type"`
+	Offset    interface{} `json:"offset"`
+	Value     json.Number `json:"value"`
+	Increment json.Number `json:"increment"`
+	Overflow  string      `json:"overflow"`
+}
+
+// Returns an operation's offset, which may be a number or a string like "#2",
+// and its value and increment, as integers; any that is missing is zero.
+//
+func (op BitFieldOperation) arguments() (offset, value, increment string, err error) {
+	switch o := op.Offset.(type) {
+	case string:
+		offset = o
+	case json.Number:
+		offset = o.String()
+	default:
+		err = fmt.Errorf("Invalid offset %v.", op.Offset)
+		return
+	}
+	if value, err = bitFieldInteger(op.Value); err == nil {
+		increment, err = bitFieldInteger(op.Increment)
+	}
+	return
+}
+
+func bitFieldInteger(n json.Number) (s string, err error) {
+	if len(n) == 0 {
+		n = "0"
+	}
+	if _, err = strconv.ParseInt(string(n), 10, 64); err != nil {
+		err = fmt.Errorf("Invalid integer %s.", n)
+		return
+	}
+	s = string(n)
+	return
+}
+
+// Handles /{db}/{key}/bitfield. A POST takes a JSON array of operations,
+// like {"op": "incrby", "type": "u8", "offset": "#0", "increment": 1,
+// "overflow": "sat"}, with "get", "set" (and "value") or "incrby". A GET
+// only reads, with "get" parameters like "u8:0". The result lists the reply
+// to each operation; null when an increment overflowed with "overflow":
+// "fail".
+//
+func HandleBitField(req *http.Request, info *RequestInfo) (response R) {
+	args := redis.Args{}.Add(info.Key)
+	if req.Method == "GET" {
+		req.ParseForm()
+		for _, g := range req.Form["get"] {
+			parts := strings.SplitN(g, ":", 2)
+			if len(parts) != 2 {
+				e := fmt.Sprintf("Invalid field %q; expected type:offset.", g)
+				response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+				return
+			}
+			args = args.Add("GET", parts[0], parts[1])
+		}
+	} else {
+		var ops []BitFieldOperation
+		if err := decodeJSON(req.Body, &ops); err != nil {
+			e := fmt.Sprintf("Could not decode the operations: %s", err)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		for _, op := range ops {
+			offset, value, increment, err := op.arguments()
+			if err != nil {
+				response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+				return
+			}
+			if len(op.Overflow) > 0 {
+				args = args.Add("OVERFLOW", strings.ToUpper(op.Overflow))
+			}
+			switch strings.ToLower(op.Op) {
+			case "get":
+				args = args.Add("GET", op.Type, offset)
+			case "set":
+				args = args.Add("SET", op.Type, offset, value)
+			case "incrby":
+				args = args.Add("INCRBY", op.Type, offset, increment)
+			default:
+				e := fmt.Sprintf("Unknown bitfield operation %q.", op.Op)
+				response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if len(args) == 1 {
+		response = R{"result": nil, "error": "No operations given."}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("BITFIELD", info.Key)
+	replies, err := redis.Values(client.Do("BITFIELD", args...))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	results := make([]interface{}, len(replies))
+	for i, r := range replies {
+		if n, ok := r.(int64); ok {
+			results[i] = n
+		}
+	}
+	response = R{"result": results, "error": nil}
+	return
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsHyperLogLog(t *testing.T) {
+	padding := strings.Repeat("\x00", 11)
+	tests := []struct {
+		s   string
+		hll bool
+	}{
+		{"HYLL\x00" + padding, true},
+		{"HYLL\x01" + padding + "\x80\x01", true},
+		{"HYLL\x02" + padding, false},
+		{"HYLL\x00" + padding[1:], false},
+		{"HYLL", false},
+		{"HYLLO, WORLD, HOW ARE YOU?", false},
+		{"hyll\x00" + padding, false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if hll := IsHyperLogLog(test.s); hll != test.hll {
+			t.Errorf("IsHyperLogLog(%q) = %v, want %v", test.s, hll, test.hll)
+		}
+	}
+}
+
+func TestBitFieldArguments(t *testing.T) {
+	tests := []struct {
+		body      string
+		offset    string
+		value     string
+		increment string
+	}{
+		{`{"op": "get", "type": "u8", "offset": "#2"}`, "#2", "0", "0"},
+		{`{"op": "set", "type": "i64", "offset": 0, "value": 9223372036854775807}`, "0", "9223372036854775807", "0"},
+		{`{"op": "incrby", "type": "i64", "offset": 4294967296, "increment": -9223372036854775808}`, "4294967296", "0", "-9223372036854775808"},
+	}
+	for _, test := range tests {
+		var op BitFieldOperation
+		if err := decodeJSON(strings.NewReader(test.body), &op); err != nil {
+			t.Fatalf("Could not decode %s: %s", test.body, err)
+		}
+		offset, value, increment, err := op.arguments()
+		if err != nil || offset != test.offset || value != test.value || increment != test.increment {
+			t.Errorf("%s: got %q %q %q, %v", test.body, offset, value, increment, err)
+		}
+	}
+
+	for _, body := range []string{
+		`{"op": "get", "type": "u8"}`,
+		`{"op": "set", "type": "i8", "offset": 0, "value": 1.5}`,
+		`{"op": "set", "type": "i64", "offset": 0, "value": 9223372036854775808}`,
+		`{"op": "get", "type": "u8", "offset": true}`,
+	} {
+		var op BitFieldOperation
+		if err := decodeJSON(strings.NewReader(body), &op); err != nil {
+			continue
+		}
+		if _, _, _, err := op.arguments(); err == nil {
+			t.Errorf("%s: want an error", body)
+		}
+	}
+	var ops []BitFieldOperation
+	if err := decodeJSON(strings.NewReader(`[{"op": "get"}] []`), &ops); err == nil {
+		t.Errorf("Trailing data after the operations was accepted")
+	}
+}
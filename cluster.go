@@ -0,0 +1,249 @@
+// cluster.go
+//
+// Support for Redis Cluster: keys are routed to the node that holds their
+// hash slot, MOVED and ASK redirects are followed, and commands that look at
+// the whole keyspace are fanned out across every master.
+//
+package main
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ClusterSlots           = 16384
+	ClusterMaxRedirects    = 5
+	ClusterRefreshInterval = 30 * time.Second
+)
+
+// A Cluster knows which master holds each hash slot, and keeps a connection
+// open to every one of them.
+//
+type Cluster struct {
+	sync.Mutex
+	seeds    []string
+	password string
+	timeouts RedisTimeouts
+	slots    [ClusterSlots]string
+	masters  []string
+	nodes    map[string]redis.Conn
+}
+
+// Connects to a cluster, loading the slot map from the first of the seed
+// nodes that answers.
+//
+func NewCluster(seeds []string, password string, timeouts RedisTimeouts) (c *Cluster, err error) {
+	c = &Cluster{
+		seeds:    seeds,
+		password: password,
+		timeouts: timeouts,
+		nodes:    make(map[string]redis.Conn),
+	}
+	err = c.Refresh()
+	return
+}
+
+// Returns the hash slot a key belongs to. If the key contains a non-empty
+// hash tag, e.g. "{user:1}:profile", only the tag is hashed, so related keys
+// can be kept on the same node.
+//
+func Slot(key string) int {
+	return int(crc16(HashTag(key)) % ClusterSlots)
+}
+
+// Returns the part of a key that decides where it is stored: the contents of
+// the first non-empty "{...}" in it, or otherwise the whole key.
+//
+func HashTag(key string) string {
+	if start := strings.Index(key, "{"); start >= 0 {
+		if end := strings.Index(key[start+1:], "}"); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// CRC16/XMODEM, as used by Redis Cluster.
+//
+func crc16(s string) (crc uint16) {
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return
+}
+
+// Reloads the slot map with CLUSTER SLOTS, asking the known masters first,
+// then the seed nodes.
+//
+func (c *Cluster) Refresh() (err error) {
+	err = errors.New("No cluster nodes reachable")
+	for _, addr := range append(c.Nodes(), c.seeds...) {
+		var conn redis.Conn
+		if conn, err = c.node(addr); err != nil {
+			continue
+		}
+		var reply []interface{}
+		if reply, err = redis.Values(conn.Do("CLUSTER", "SLOTS")); err != nil {
+			c.forget(addr)
+			continue
+		}
+		if err = c.load(reply); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// Parses a CLUSTER SLOTS reply, and swaps in the new slot map.
+//
+func (c *Cluster) load(reply []interface{}) (err error) {
+	var slots [ClusterSlots]string
+	seen := make(map[string]bool)
+	var masters []string
+
+	for _, r := range reply {
+		// start end [master-ip master-port ...] [replica ...]...
+		//
+		entry, e := redis.Values(r, nil)
+		if e != nil || len(entry) < 3 {
+			err = errors.New("Unexpected reply to CLUSTER SLOTS")
+			return
+		}
+		start, _ := redis.Int(entry[0], nil)
+		end, _ := redis.Int(entry[1], nil)
+		master, e := redis.Values(entry[2], nil)
+		if e != nil || len(master) < 2 || start < 0 || end >= ClusterSlots {
+			err = errors.New("Unexpected reply to CLUSTER SLOTS")
+			return
+		}
+		host, _ := redis.String(master[0], nil)
+		port, _ := redis.Int(master[1], nil)
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = addr
+		}
+		if !seen[addr] {
+			seen[addr] = true
+			masters = append(masters, addr)
+		}
+	}
+
+	c.Lock()
+	c.slots = slots
+	c.masters = masters
+	var stale []string
+	for addr := range c.nodes {
+		if !seen[addr] {
+			stale = append(stale, addr)
+		}
+	}
+	c.Unlock()
+	for _, addr := range stale {
+		c.forget(addr)
+	}
+	return
+}
+
+// Refreshes the slot map every ClusterRefreshInterval, so changes that
+// haven't caused a redirect yet are still picked up. This never returns; run
+// it in its own goroutine.
+//
+func (c *Cluster) Watch() {
+	for {
+		time.Sleep(ClusterRefreshInterval)
+		if err := c.Refresh(); err != nil {
+			println("CLUSTER", "could not refresh slots:", err.Error())
+		}
+	}
+}
+
+// Returns the addresses of all of the masters.
+//
+func (c *Cluster) Nodes() (addrs []string) {
+	c.Lock()
+	defer c.Unlock()
+	addrs = append(addrs, c.masters...)
+	return
+}
+
+// Returns the address of the master holding a key.
+//
+func (c *Cluster) NodeFor(key string) (addr string) {
+	c.Lock()
+	defer c.Unlock()
+	addr = c.slots[Slot(key)]
+	return
+}
+
+func (c *Cluster) dial(addr string, wait time.Duration) (conn redis.Conn, err error) {
+	conn, err = ConnectToRedisHost(addr, c.password, 0, c.timeouts.Blocking(wait))
+	return
+}
+
+// Returns the shared connection to a node, connecting to it if need be, or
+// if the connection has broken.
+//
+func (c *Cluster) node(addr string) (conn redis.Conn, err error) {
+	c.Lock()
+	conn, ok := c.nodes[addr]
+	c.Unlock()
+	if ok && conn.Err() == nil {
+		return
+	}
+	broken := conn
+	if conn, err = c.dial(addr, 0); err != nil {
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if existing, ok := c.nodes[addr]; ok && existing != broken && existing.Err() == nil {
+		conn.Close()
+		conn = existing
+		return
+	}
+	c.nodes[addr] = conn
+	return
+}
+
+// Drops (and closes) the shared connection to a node.
+//
+func (c *Cluster) forget(addr string) {
+	c.Lock()
+	conn, ok := c.nodes[addr]
+	delete(c.nodes, addr)
+	c.Unlock()
+	if ok {
+		conn.Close()
+	}
+	return
+}
+
+// Returns a client that routes each command to the right node, using the
+// shared connections.
+//
+func (c *Cluster) Conn() redis.Conn {
+	return &routedConn{router: c}
+}
+
+// Returns a client that routes each command to the right node, over
+// connections of its own, whose read timeouts are extended by wait for
+// blocking commands. Closing it closes them.
+//
+func (c *Cluster) DedicatedConn(wait time.Duration) redis.Conn {
+	return &routedConn{router: c, own: make(map[string]redis.Conn), wait: wait}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSlot(t *testing.T) {
+	tests := []struct {
+		key  string
+		slot int
+	}{
+		{"123456789", 12739},
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"{foo}bar", 12182},
+		{"x{bar}y", 5061},
+	}
+	for _, test := range tests {
+		if slot := Slot(test.key); slot != test.slot {
+			t.Errorf("Slot(%q) = %d, want %d", test.key, slot, test.slot)
+		}
+	}
+
+	if Slot("{user1000}.following") != Slot("{user1000}.followers") {
+		t.Errorf("keys with the same hash tag are in different slots")
+	}
+}
+
+func TestHashTag(t *testing.T) {
+	tests := []struct {
+		key, tag string
+	}{
+		{"user:1", "user:1"},
+		{"{user1000}.following", "user1000"},
+		{"foo{bar}{zap}", "bar"},
+		{"foo{{bar}}zap", "{bar"},
+		{"{}", "{}"},
+		{"foo{}{bar}", "foo{}{bar}"},
+		{"foo{bar", "foo{bar"},
+		{"foo}bar{", "foo}bar{"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if tag := HashTag(test.key); tag != test.tag {
+			t.Errorf("HashTag(%q) = %q, want %q", test.key, tag, test.tag)
+		}
+	}
+}
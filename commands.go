@@ -0,0 +1,136 @@
+// commands.go
+//
+// Knows where the key names are in the arguments of the Redis commands
+// Scarlet issues, so they can be routed (or rewritten) without every handler
+// having to care.
+//
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Commands that do not operate on keys at all.
+//
+var keylessCommands = map[string]bool{
+	"AUTH": true, "CLUSTER": true, "CONFIG": true, "DBSIZE": true,
+	"DISCARD": true, "ECHO": true, "EXEC": true, "FLUSHDB": true,
+	"INFO": true, "KEYS": true, "MULTI": true, "PING": true,
+	"PUBLISH": true, "RANDOMKEY": true, "SCAN": true, "SCRIPT": true,
+	"SELECT": true, "SENTINEL": true, "TIME": true, "UNWATCH": true,
+}
+
+// Commands where every argument is a key.
+//
+var allKeyCommands = map[string]bool{
+	"DEL": true, "EXISTS": true, "MGET": true, "PFCOUNT": true,
+	"PFMERGE": true, "SDIFF": true, "SDIFFSTORE": true, "SINTER": true,
+	"SINTERSTORE": true, "SUNION": true, "SUNIONSTORE": true, "TOUCH": true,
+	"UNLINK": true, "WATCH": true,
+}
+
+// Commands where the first two arguments are keys.
+//
+var twoKeyCommands = map[string]bool{
+	"BLMOVE": true, "BRPOPLPUSH": true, "COPY": true, "GEOSEARCHSTORE": true,
+	"LMOVE": true, "RENAME": true, "RENAMENX": true, "RPOPLPUSH": true,
+	"SMOVE": true,
+}
+
+// Commands whose last argument is a timeout, and all the others are keys.
+//
+var blockingCommands = map[string]bool{
+	"BLPOP": true, "BRPOP": true, "BZPOPMAX": true, "BZPOPMIN": true,
+}
+
+// Returns the indexes of the arguments to a command that are key names.
+//
+func CommandKeys(cmd string, args []interface{}) (keys []int) {
+	cmd = strings.ToUpper(cmd)
+	switch {
+	case len(args) == 0 || keylessCommands[cmd]:
+
+	case allKeyCommands[cmd]:
+		for i := range args {
+			keys = append(keys, i)
+		}
+
+	case twoKeyCommands[cmd]:
+		keys = []int{0}
+		if len(args) > 1 {
+			keys = append(keys, 1)
+		}
+
+	case blockingCommands[cmd]:
+		for i := 0; i < len(args)-1; i++ {
+			keys = append(keys, i)
+		}
+
+	case cmd == "EVAL" || cmd == "EVALSHA":
+		// EVAL script numkeys key [key ...] arg [arg ...]
+		//
+		if len(args) > 1 {
+			keys = countedKeys(args, 1)
+		}
+
+	case cmd == "ZUNIONSTORE" || cmd == "ZINTERSTORE":
+		// ZUNIONSTORE destination numkeys key [key ...] ...
+		//
+		keys = []int{0}
+		if len(args) > 1 {
+			keys = append(keys, countedKeys(args, 1)...)
+		}
+
+	case cmd == "BITOP":
+		// BITOP operation destkey key [key ...]
+		//
+		for i := 1; i < len(args); i++ {
+			keys = append(keys, i)
+		}
+
+	case cmd == "MSET" || cmd == "MSETNX":
+		for i := 0; i < len(args); i += 2 {
+			keys = append(keys, i)
+		}
+
+	default:
+		keys = []int{0}
+	}
+	return
+}
+
+// Returns the indexes of the keys following a "numkeys" argument.
+//
+func countedKeys(args []interface{}, numkeys int) (keys []int) {
+	n, err := strconv.Atoi(argString(args[numkeys]))
+	if err != nil {
+		return
+	}
+	for i := numkeys + 1; i <= numkeys+n && i < len(args); i++ {
+		keys = append(keys, i)
+	}
+	return
+}
+
+// Returns the first key a command operates on, if it has one.
+//
+func FirstKey(cmd string, args []interface{}) (key string, ok bool) {
+	if keys := CommandKeys(cmd, args); len(keys) > 0 {
+		key, ok = argString(args[keys[0]]), true
+	}
+	return
+}
+
+func argString(arg interface{}) (s string) {
+	switch a := arg.(type) {
+	case string:
+		s = a
+	case []byte:
+		s = string(a)
+	default:
+		s = fmt.Sprint(a)
+	}
+	return
+}
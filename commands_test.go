@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		args []interface{}
+		keys []int
+	}{
+		{"GET", []interface{}{"k"}, []int{0}},
+		{"set", []interface{}{"k", "v"}, []int{0}},
+		{"HSET", []interface{}{"k", "f", "v"}, []int{0}},
+		{"PING", nil, nil},
+		{"PUBLISH", []interface{}{"channel", "message"}, nil},
+		{"SCAN", []interface{}{"0", "MATCH", "*"}, nil},
+		{"DEL", []interface{}{"a", "b", "c"}, []int{0, 1, 2}},
+		{"MGET", []interface{}{"a", "b"}, []int{0, 1}},
+		{"RENAME", []interface{}{"a", "b"}, []int{0, 1}},
+		{"LMOVE", []interface{}{"a", "b", "LEFT", "RIGHT"}, []int{0, 1}},
+		{"COPY", []interface{}{"a"}, []int{0}},
+		{"BLPOP", []interface{}{"a", "b", 5}, []int{0, 1}},
+		{"BZPOPMIN", []interface{}{"a", 0}, []int{0}},
+		{"EVAL", []interface{}{"return 1", 2, "a", "b", "arg"}, []int{2, 3}},
+		{"EVALSHA", []interface{}{"sha", "0", "arg"}, nil},
+		{"EVAL", []interface{}{"return 1", 3, "a"}, []int{2}},
+		{"EVAL", []interface{}{"return 1", "x", "a"}, nil},
+		{"ZUNIONSTORE", []interface{}{"dst", 2, "a", "b", "WEIGHTS", 1, 2}, []int{0, 2, 3}},
+		{"ZINTERSTORE", []interface{}{"dst"}, []int{0}},
+		{"BITOP", []interface{}{"AND", "dst", "a", "b"}, []int{1, 2, 3}},
+		{"MSET", []interface{}{"a", 1, "b", 2}, []int{0, 2}},
+		{"MSETNX", []interface{}{"a", 1}, []int{0}},
+		{"GET", nil, nil},
+	}
+	for _, test := range tests {
+		if keys := CommandKeys(test.cmd, test.args); !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("CommandKeys(%s, %v) = %v, want %v", test.cmd, test.args, keys, test.keys)
+		}
+	}
+}
+
+func TestFirstKey(t *testing.T) {
+	if key, ok := FirstKey("BITOP", []interface{}{"OR", "dst", "a"}); !ok || key != "dst" {
+		t.Errorf("FirstKey(BITOP) = %q, %v", key, ok)
+	}
+	if key, ok := FirstKey("EVAL", []interface{}{"s", 1, []byte("k")}); !ok || key != "k" {
+		t.Errorf("FirstKey(EVAL) = %q, %v", key, ok)
+	}
+	if _, ok := FirstKey("PING", nil); ok {
+		t.Errorf("FirstKey(PING) found a key")
+	}
+}
@@ -9,12 +9,84 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
+	"time"
+)
+
+const (
+	DefaultStreamThreshold   = 10000
+	DefaultStreamBatchSize   = 1000
+	DefaultRequestTimeout    = 30 * time.Second
+	DefaultMaxRequestTimeout = 5 * time.Minute
+	DefaultConnectTimeout    = 5 * time.Second
 )
 
 type ServerBlock struct {
 	Enabled       bool   `json:enabled`
 	ListenAddress string `json:listenAddress`
 	Port          int    `json:port`
+
+	// Collections with more elements than this are streamed to the client,
+	// rather than being read into memory first. A negative value means
+	// collections are only streamed when the client asks for it.
+	//
+	StreamThreshold int `json:"streamThreshold"`
+
+	// How many elements are fetched from Redis at a time, when streaming.
+	//
+	StreamBatchSize int `json:"streamBatchSize"`
+
+	// How long a request may take, e.g. "30s". Clients can ask for a
+	// different deadline with the X-Scarlet-Timeout header, up to
+	// MaxRequestTimeout.
+	//
+	RequestTimeout    string `json:"requestTimeout"`
+	MaxRequestTimeout string `json:"maxRequestTimeout"`
+
+	CORS CORSBlock `json:"cors"`
+
+	// Extra headers to set on every response.
+	//
+	Headers map[string]string `json:"headers"`
+}
+
+// Cross-origin resource sharing settings. Origins may include "*", to allow
+// any origin, but then not with AllowCredentials; credentials are only
+// allowed for the origins listed by name.
+//
+type CORSBlock struct {
+	AllowedOrigins   []string `json:"allowedOrigins"`
+	AllowedMethods   []string `json:"allowedMethods"`
+	AllowedHeaders   []string `json:"allowedHeaders"`
+	ExposedHeaders   []string `json:"exposedHeaders"`
+	AllowCredentials bool     `json:"allowCredentials"`
+
+	// How long, in seconds, browsers may cache the result of a preflight
+	// request.
+	//
+	MaxAge int `json:"maxAge"`
+}
+
+// Returns the default and maximum request deadlines.
+//
+func (s ServerBlock) RequestTimeouts() (timeout, max time.Duration) {
+	timeout, _ = parseDuration(s.RequestTimeout, DefaultRequestTimeout)
+	max, _ = parseDuration(s.MaxRequestTimeout, DefaultMaxRequestTimeout)
+	return
+}
+
+// Returns the streaming threshold and batch size, falling back to the
+// defaults for anything that was not set.
+//
+func (s ServerBlock) StreamLimits() (threshold, batch int) {
+	threshold, batch = s.StreamThreshold, s.StreamBatchSize
+	if threshold == 0 {
+		threshold = DefaultStreamThreshold
+	}
+	if batch <= 0 {
+		batch = DefaultStreamBatchSize
+	}
+	return
 }
 
 type RedisBlock struct {
@@ -24,6 +96,95 @@ type RedisBlock struct {
 	PropagateWrites bool   `json:propagateWritesToMaster`
 	Password        string `json:password`
 	DisableInfo     bool   `json:disableInfo`
+
+	// Timeouts for connecting to, reading from, and writing to Redis, e.g.
+	// "500ms". Reads and writes are not bounded unless set.
+	//
+	ConnectTimeout string `json:"connectTimeout"`
+	ReadTimeout    string `json:"readTimeout"`
+	WriteTimeout   string `json:"writeTimeout"`
+
+	// How many connections to each database requests may use at once
+	// (DefaultPoolSize, unless set).
+	//
+	PoolSize int `json:"poolSize"`
+
+	// When Sentinels are listed, the master is looked up through them
+	// (by MasterName), instead of connecting to Host and Port.
+	//
+	Sentinels  []string `json:"sentinels"`
+	MasterName string   `json:"masterName"`
+
+	// The addresses ("host:port") of the master's replicas, for when
+	// Sentinel isn't there to find them. Only used in read-only mode, when
+	// readOnly.replicasOnly is set.
+	//
+	Replicas []string `json:"replicas"`
+
+	// Treat the upstream as a Redis Cluster. The slot map is loaded from
+	// the first of ClusterNodes that answers (or from Host and Port, if
+	// none are listed).
+	//
+	Cluster      bool     `json:"cluster"`
+	ClusterNodes []string `json:"clusterNodes"`
+
+	// Spread the keyspace over several independent Redis servers, instead
+	// of using Host and Port.
+	//
+	Shards []ShardBlock `json:"shards"`
+
+	// Maps API keys to the access they have: "read", or "write" (which
+	// includes reading). If any are listed, requests without one of them
+	// are turned away.
+	//
+	ACL map[string]string `json:"acl"`
+}
+
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+)
+
+// One of the servers a sharded keyspace is spread over. Keys are assigned to
+// shards by name, so the name must stay the same if the server moves.
+//
+type ShardBlock struct {
+	Name     string `json:"name"`
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Password string `json:"password"`
+}
+
+type RedisTimeouts struct {
+	Connect time.Duration
+	Read    time.Duration
+	Write   time.Duration
+}
+
+// Returns the timeouts for a connection used for blocking commands that may
+// wait for as long as wait: the read timeout is extended by it. No read
+// timeout stays none.
+//
+func (t RedisTimeouts) Blocking(wait time.Duration) RedisTimeouts {
+	if wait > 0 && t.Read > 0 {
+		t.Read += wait
+	}
+	return t
+}
+
+func (r RedisBlock) Timeouts() (t RedisTimeouts) {
+	t.Connect, _ = parseDuration(r.ConnectTimeout, DefaultConnectTimeout)
+	t.Read, _ = parseDuration(r.ReadTimeout, 0)
+	t.Write, _ = parseDuration(r.WriteTimeout, 0)
+	return
+}
+
+func (r RedisBlock) Pool() (size int) {
+	size = r.PoolSize
+	if size <= 0 {
+		size = DefaultPoolSize
+	}
+	return
 }
 
 func (r RedisBlock) InfoDisabled() (p bool) {
@@ -36,10 +197,196 @@ func (r RedisBlock) ConnectAddr() (addr string) {
 	return
 }
 
+// A Limit describes a token bucket: Rate tokens are added every second, up to
+// Burst tokens. A Rate of zero means there is no limit.
+//
+type Limit struct {
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+type Limits struct {
+	Reads  Limit `json:"reads"`
+	Writes Limit `json:"writes"`
+}
+
+// A LimitScope holds the limits applied to every API key, source address or
+// database, and any overrides for specific ones.
+//
+type LimitScope struct {
+	Default   Limits            `json:"default"`
+	Overrides map[string]Limits `json:"overrides"`
+}
+
+// Returns the limits for the given API key, address or database.
+//
+func (s LimitScope) For(name string) (l Limits) {
+	l = s.Default
+	if o, ok := s.Overrides[name]; ok {
+		l = o
+	}
+	return
+}
+
+type RateLimitBlock struct {
+	Enabled bool `json:"enabled"`
+
+	// Keep the buckets in Redis (in database 0), so that several instances
+	// of Scarlet share the same quotas.
+	//
+	Shared bool `json:"shared"`
+
+	// Use the first address in the X-Forwarded-For header as the source
+	// address, for when Scarlet sits behind a proxy.
+	//
+	TrustForwardedFor bool `json:"trustForwardedFor"`
+
+	APIKey   LimitScope `json:"apiKey"`
+	IP       LimitScope `json:"ip"`
+	Database LimitScope `json:"database"`
+}
+
 type Configuration struct {
-	HTTP  ServerBlock `json:http`
-	TCP   ServerBlock `json:tcp`
-	Redis RedisBlock  `json:redis`
+	HTTP      ServerBlock    `json:http`
+	TCP       ServerBlock    `json:tcp`
+	Redis     RedisBlock     `json:redis`
+	RateLimit RateLimitBlock `json:"rateLimit"`
+
+	// More Redis hosts, addressed as /{upstream}/{db}/{key}. The "redis"
+	// block is the default upstream, used when no name is given.
+	//
+	Upstreams map[string]RedisBlock `json:"upstreams"`
+
+	Tenants []TenantBlock `json:"tenants"`
+
+	ReadOnly ReadOnlyBlock `json:"readOnly"`
+
+	Schemas []SchemaBlock `json:"schemas"`
+
+	Queues QueueBlock `json:"queues"`
+
+	Locks LockBlock `json:"locks"`
+
+	Schedule ScheduleBlock `json:"schedule"`
+
+	Webhooks []WebhookBlock `json:"webhooks"`
+
+	// API keys allowed to use the /_admin endpoints.
+	//
+	AdminKeys []string `json:"adminKeys"`
+
+	// Turn away requests that don't belong to any tenant. Unless it is set,
+	// they are turned away whenever any tenants are configured, since they
+	// would see every tenant's keys.
+	//
+	RequireTenant *bool `json:"requireTenant"`
+}
+
+// Returns true if requests that don't belong to a tenant are turned away.
+//
+func (c *Configuration) TenantRequired() (p bool) {
+	p = len(c.Tenants) > 0
+	if c.RequireTenant != nil {
+		p = *c.RequireTenant
+	}
+	return
+}
+
+// Job queues, served under /_queues/, are kept in Database on the default
+// upstream. Jobs that aren't acknowledged within VisibilityTimeout are
+// delivered again, up to MaxAttempts times in all, and then moved to the
+// queue's dead-letter list. The reaper looks for them every ReapInterval.
+//
+type QueueBlock struct {
+	Enabled           bool   `json:"enabled"`
+	Database          int    `json:"database"`
+	VisibilityTimeout string `json:"visibilityTimeout"`
+	MaxAttempts       int    `json:"maxAttempts"`
+	ReapInterval      string `json:"reapInterval"`
+}
+
+func (q QueueBlock) maxAttempts() (n int) {
+	n = q.MaxAttempts
+	if n <= 0 {
+		n = DefaultQueueMaxAttempts
+	}
+	return
+}
+
+// Locks, served under /_locks/, are kept in Database on the default
+// upstream. They're held for DefaultTTL unless a "ttl" is given, and never
+// for longer than MaxTTL.
+//
+type LockBlock struct {
+	Enabled    bool   `json:"enabled"`
+	Database   int    `json:"database"`
+	DefaultTTL string `json:"defaultTTL"`
+	MaxTTL     string `json:"maxTTL"`
+}
+
+// Requests scheduled with "at" or "delay" are kept in Database on the
+// default upstream, which the scheduler checks for due ones every Interval.
+// A claimed request that hasn't finished running within Lease (its instance
+// may have died) is put back on the schedule, so Lease should be longer than
+// any request takes.
+//
+type ScheduleBlock struct {
+	Enabled  bool   `json:"enabled"`
+	Database int    `json:"database"`
+	Interval string `json:"interval"`
+	Lease    string `json:"lease"`
+}
+
+// A webhook is sent the keyspace notifications for the keys in Databases
+// (database 0, by default) of an upstream, optionally narrowed down to keys
+// matching one of the Keys patterns, and to the Events named (like "set",
+// "del" or "expired"). Events are signed with Secret, if there is one.
+//
+type WebhookBlock struct {
+	Name        string   `json:"name"`
+	URL         string   `json:"url"`
+	Secret      string   `json:"secret"`
+	Upstream    string   `json:"upstream"`
+	Databases   []int    `json:"databases"`
+	Keys        []string `json:"keys"`
+	Events      []string `json:"events"`
+	Timeout     string   `json:"timeout"`
+	MaxAttempts int      `json:"maxAttempts"`
+}
+
+// A tenant's keys are all stored under Prefix (e.g. "tenantA:"). Requests
+// belong to a tenant if they carry one of its API keys, or are sent to one of
+// its Hosts.
+//
+type TenantBlock struct {
+	Name    string   `json:"name"`
+	Prefix  string   `json:"prefix"`
+	APIKeys []string `json:"apiKeys"`
+	Hosts   []string `json:"hosts"`
+}
+
+// Read-only mode turns away every request that would write to Redis, either
+// everywhere (Enabled), or only for some Databases, named as in rate limit
+// overrides: "3" for the default upstream, or "{upstream}/3".
+//
+type ReadOnlyBlock struct {
+	Enabled   bool     `json:"enabled"`
+	Databases []string `json:"databases"`
+
+	// Connect to the upstreams' replicas, rather than their masters. Read-
+	// only mode can't be turned off at runtime when this is set.
+	//
+	ReplicasOnly bool `json:"replicasOnly"`
+}
+
+// JSON documents stored under keys matching Pattern (a Redis-style glob, like
+// "user:*") must be valid against a JSON Schema, given either inline, or in
+// File.
+//
+type SchemaBlock struct {
+	Pattern string          `json:"pattern"`
+	Schema  json.RawMessage `json:"schema"`
+	File    string          `json:"file"`
 }
 
 func LoadConfig(path string) (config *Configuration, err error) {
@@ -73,6 +420,157 @@ func (conf *Configuration) Validate() (err error) {
 	//
 	if conf.Redis.Protocol != "unix" && conf.Redis.Protocol != "tcp" {
 		err = errors.New("Redis protocol must be one of \"tcp\" or \"unix\"")
+		return
+	}
+	if err = conf.Redis.Validate("redis"); err != nil {
+		return
+	}
+
+	for name, block := range conf.Upstreams {
+		if !UpstreamNameRegex.MatchString(name) {
+			err = fmt.Errorf("Invalid upstream name %q: names must start with a letter", name)
+			return
+		}
+		if err = block.Validate("upstreams." + name); err != nil {
+			return
+		}
+	}
+
+	for _, o := range conf.HTTP.CORS.AllowedOrigins {
+		if o == "*" && conf.HTTP.CORS.AllowCredentials {
+			err = errors.New("http.cors.allowCredentials can't be used with the \"*\" origin; list the origins instead")
+			return
+		}
+	}
+
+	if conf.ReadOnly.ReplicasOnly && !conf.ReadOnly.Enabled {
+		err = errors.New("readOnly.replicasOnly requires readOnly.enabled")
+		return
+	}
+	if conf.ReadOnly.ReplicasOnly {
+		// Reads from cluster and sharded upstreams are always routed to
+		// their masters.
+		//
+		blocks := map[string]RedisBlock{"redis": conf.Redis}
+		for name, block := range conf.Upstreams {
+			blocks["upstreams."+name] = block
+		}
+		for name, block := range blocks {
+			if block.Cluster || len(block.Shards) > 0 {
+				err = fmt.Errorf("readOnly.replicasOnly can't be used with a cluster or sharded upstream (%s)", name)
+				return
+			}
+		}
+	}
+
+	for _, tenant := range conf.Tenants {
+		if len(tenant.Prefix) == 0 {
+			err = fmt.Errorf("Tenant %q needs a prefix", tenant.Name)
+			return
+		}
+	}
+
+	hooks := make(map[string]bool)
+	for _, hook := range conf.Webhooks {
+		if len(hook.Name) == 0 || hooks[hook.Name] {
+			err = errors.New("Every webhook needs a unique name")
+			return
+		}
+		hooks[hook.Name] = true
+		if u, e := url.Parse(hook.URL); e != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			err = fmt.Errorf("Invalid URL for webhook %s: %q", hook.Name, hook.URL)
+			return
+		}
+		if _, ok := conf.Upstreams[hook.Upstream]; !ok && len(hook.Upstream) > 0 {
+			err = fmt.Errorf("Unknown upstream for webhook %s: %s", hook.Name, hook.Upstream)
+			return
+		}
+		if _, err = parseDuration(hook.Timeout, 0); err != nil {
+			err = fmt.Errorf("Invalid duration for webhook %s timeout: %s", hook.Name, err)
+			return
+		}
+	}
+
+	// Make sure all of the timeouts can be parsed.
+	//
+	durations := map[string]string{
+		"http.requestTimeout":      conf.HTTP.RequestTimeout,
+		"http.maxRequestTimeout":   conf.HTTP.MaxRequestTimeout,
+		"queues.visibilityTimeout": conf.Queues.VisibilityTimeout,
+		"queues.reapInterval":      conf.Queues.ReapInterval,
+		"locks.defaultTTL":         conf.Locks.DefaultTTL,
+		"locks.maxTTL":             conf.Locks.MaxTTL,
+		"schedule.interval":        conf.Schedule.Interval,
+		"schedule.lease":           conf.Schedule.Lease,
+	}
+	for name, d := range durations {
+		if _, err = parseDuration(d, 0); err != nil {
+			err = fmt.Errorf("Invalid duration for %s: %s", name, err)
+			return
+		}
+	}
+	return
+}
+
+// Validates the settings of a single Redis upstream; prefix is used to name
+// it in error messages.
+//
+func (r RedisBlock) Validate(prefix string) (err error) {
+	if r.Cluster && len(r.Sentinels) > 0 {
+		err = fmt.Errorf("%s.cluster cannot be combined with Sentinels", prefix)
+		return
+	}
+	if len(r.Shards) > 0 && (r.Cluster || len(r.Sentinels) > 0) {
+		err = fmt.Errorf("%s.shards cannot be combined with cluster mode or Sentinels", prefix)
+		return
+	}
+	names := make(map[string]bool)
+	for _, shard := range r.Shards {
+		if len(shard.Name) == 0 || names[shard.Name] {
+			err = fmt.Errorf("Every shard in %s.shards needs a unique name", prefix)
+			return
+		}
+		names[shard.Name] = true
+	}
+
+	if len(r.Replicas) > 0 && (r.Cluster || len(r.Shards) > 0) {
+		err = fmt.Errorf("%s.replicas cannot be combined with cluster mode or shards", prefix)
+		return
+	}
+
+	if len(r.Sentinels) > 0 && len(r.MasterName) == 0 {
+		err = fmt.Errorf("%s.masterName is required when using Sentinels", prefix)
+		return
+	}
+
+	for apiKey, access := range r.ACL {
+		if access != AccessRead && access != AccessWrite {
+			err = fmt.Errorf("Invalid access %q for API key %q in %s.acl", access, apiKey, prefix)
+			return
+		}
+	}
+
+	durations := map[string]string{
+		"connectTimeout": r.ConnectTimeout,
+		"readTimeout":    r.ReadTimeout,
+		"writeTimeout":   r.WriteTimeout,
+	}
+	for name, d := range durations {
+		if _, err = parseDuration(d, 0); err != nil {
+			err = fmt.Errorf("Invalid duration for %s.%s: %s", prefix, name, err)
+			return
+		}
+	}
+	return
+}
+
+// Parses a duration like "1.5s", returning def if s is empty.
+//
+func parseDuration(s string, def time.Duration) (d time.Duration, err error) {
+	if len(s) == 0 {
+		d = def
+		return
 	}
+	d, err = time.ParseDuration(s)
 	return
 }
@@ -0,0 +1,112 @@
+// cors.go
+//
+// Cross-origin resource sharing, and the extra response headers set from the
+// configuration.
+//
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	DefaultCORSMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	DefaultCORSHeaders = []string{"Content-Type", APIKeyHeader, TimeoutHeader}
+	DefaultCORSExposed = []string{"X-Scarlet-Encoding", "X-Scarlet-Streamed", "Retry-After"}
+)
+
+// Wraps a handler, so that every response carries the configured headers and
+// CORS headers, and OPTIONS requests (including CORS preflight requests) are
+// answered without ever reaching the handler.
+//
+func WithHeaders(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, req *http.Request) {
+		for name, value := range config.HTTP.Headers {
+			rw.Header().Set(name, value)
+		}
+		cors := config.HTTP.CORS
+		allowed := cors.allowOrigin(rw, req)
+
+		if req.Method == "OPTIONS" {
+			rw.Header().Set("Allow", strings.Join(cors.methods(), ", "))
+			if allowed && len(req.Header.Get("Access-Control-Request-Method")) > 0 {
+				cors.preflight(rw, req)
+			}
+			rw.WriteHeader(http.StatusNoContent)
+			return
+		}
+		handler(rw, req)
+		return
+	}
+}
+
+// Sets the Access-Control-Allow-Origin header (and friends) if the request
+// came from an allowed origin.
+//
+func (c CORSBlock) allowOrigin(rw http.ResponseWriter, req *http.Request) (allowed bool) {
+	origin := req.Header.Get("Origin")
+	if len(origin) == 0 || len(c.AllowedOrigins) == 0 {
+		return
+	}
+	rw.Header().Add("Vary", "Origin")
+
+	listed := false
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			allowed = true
+		} else if strings.EqualFold(o, origin) {
+			allowed, listed = true, true
+		}
+	}
+	if !allowed {
+		return
+	}
+
+	// Credentials are only ever allowed for the origins listed by name;
+	// otherwise any website could make credentialed calls.
+	//
+	if listed {
+		rw.Header().Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			rw.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+	} else {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+
+	exposed := c.ExposedHeaders
+	if len(exposed) == 0 {
+		exposed = DefaultCORSExposed
+	}
+	rw.Header().Set("Access-Control-Expose-Headers", strings.Join(exposed, ", "))
+	return
+}
+
+// Answers a preflight request.
+//
+func (c CORSBlock) preflight(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Add("Vary", "Access-Control-Request-Method")
+	rw.Header().Add("Vary", "Access-Control-Request-Headers")
+	rw.Header().Set("Access-Control-Allow-Methods", strings.Join(c.methods(), ", "))
+
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	rw.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+
+	if c.MaxAge > 0 {
+		rw.Header().Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	return
+}
+
+func (c CORSBlock) methods() (methods []string) {
+	methods = c.AllowedMethods
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	return
+}
@@ -0,0 +1,123 @@
+// counter.go
+//
+// Atomic counters: incrementing and decrementing string keys, hash fields
+// and sorted set members, without a racy read-then-write.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+)
+
+func init() {
+	Operations["incr"] = Operation{Methods: []string{"POST"}, Handler: HandleIncrement}
+	Operations["decr"] = Operation{Methods: []string{"POST"}, Handler: HandleIncrement}
+	return
+}
+
+// Handles POST /{db}/{key}/incr and /decr. The amount is given with the "by"
+// parameter (1 by default), and may be fractional. Hash fields are named
+// with the "field" parameter, and sorted set members with "member"; a key
+// that doesn't exist yet is created as a string, unless one of those is
+// given. The result is the new value.
+//
+func HandleIncrement(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	by := req.FormValue("by")
+	if len(by) == 0 {
+		by = "1"
+	}
+	amount, ierr := strconv.ParseInt(by, 10, 64)
+	famount, ferr := strconv.ParseFloat(by, 64)
+	if ferr != nil {
+		e := fmt.Sprintf("Invalid amount: %s", by)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	isInt := ierr == nil
+	if info.Op == "decr" {
+		amount, famount = -amount, -famount
+	}
+
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	field, member := req.FormValue("field"), req.FormValue("member")
+	if keytype == "none" {
+		switch {
+		case len(field) > 0:
+			keytype = "hash"
+		case len(member) > 0:
+			keytype = "zset"
+		default:
+			keytype = "string"
+		}
+	}
+
+	var v interface{}
+	switch keytype {
+	case "string":
+		if isInt {
+			println("INCRBY", info.Key, amount)
+			v, err = client.Do("INCRBY", info.Key, amount)
+		} else {
+			println("INCRBYFLOAT", info.Key, famount)
+			v, err = client.Do("INCRBYFLOAT", info.Key, famount)
+		}
+
+	case "hash":
+		if len(field) == 0 {
+			e := "Missing required parameter: field."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		if isInt {
+			println("HINCRBY", info.Key, field, amount)
+			v, err = client.Do("HINCRBY", info.Key, field, amount)
+		} else {
+			println("HINCRBYFLOAT", info.Key, field, famount)
+			v, err = client.Do("HINCRBYFLOAT", info.Key, field, famount)
+		}
+
+	case "zset":
+		if len(member) == 0 {
+			e := "Missing required parameter: member."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		println("ZINCRBY", info.Key, famount, member)
+		v, err = client.Do("ZINCRBY", info.Key, famount, member)
+
+	default:
+		e := fmt.Sprintf("Cannot increment a %s.", keytype)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+
+	// Integers come back as integers, and everything else as a string
+	// holding the new value.
+	//
+	var result interface{}
+	if n, ok := v.(int64); ok {
+		result = n
+	} else if result, err = redis.Float64(v, nil); err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	response = R{"result": result, "error": nil}
+	return
+}
@@ -12,7 +12,7 @@ import (
 // Handles HTTP POST requests, intended for creating new keys.
 //
 func HandleCreateOperation(req *http.Request, info *RequestInfo) (response R) {
-	client, err := Database.DB(info.DbNum)
+	client, err := info.DB()
 	v, err := client.Do("EXISTS", info.Key)
 	if err != nil {
 		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
@@ -61,7 +61,11 @@ func HandleCreateOperation(req *http.Request, info *RequestInfo) (response R) {
 	// Let's just quickly make sure the user actually supplied a value to
 	// be set.
 	//
-	value := req.FormValue("value")
+	value, err := RequestValue(req)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
 	if len(value) == 0 {
 		response = R{"result": nil, "error": "No value provided."}
 		return
@@ -72,6 +76,9 @@ func HandleCreateOperation(req *http.Request, info *RequestInfo) (response R) {
 	//
 	switch keytype {
 	case "string":
+		if response = ValidateValue(info.Key, value); response != nil {
+			return
+		}
 		_, err = client.Do("SET", info.Key, value)
 
 	case "list":
@@ -8,7 +8,7 @@ import (
 )
 
 func HandleDeleteOperation(req *http.Request, info *RequestInfo) (response R) {
-	client, err := Database.DB(info.DbNum)
+	client, err := info.DB()
 	v, err := client.Do("EXISTS", info.Key)
 	if err != nil {
 		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
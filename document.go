@@ -0,0 +1,415 @@
+// document.go
+//
+// JSON documents stored in string keys: reading parts of them with a subset
+// of JSONPath, and changing them with JSON Patch (RFC 6902).
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The media type of JSON Patch documents.
+//
+const JSONPatchType = "application/json-patch+json"
+
+type pathStep struct {
+	name     string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Parses the supported subset of JSONPath: "$" followed by any number of
+// ".name", "['name']", "[n]" (negative indexes count from the end), ".*"
+// and "[*]" steps. Returns whether the path can match more than one value.
+//
+func ParsePath(path string) (steps []pathStep, multiple bool, err error) {
+	if !strings.HasPrefix(path, "$") {
+		err = errors.New("Paths must start with $")
+		return
+	}
+	p := path[1:]
+	for len(p) > 0 {
+		switch {
+		case strings.HasPrefix(p, ".*"):
+			steps = append(steps, pathStep{wildcard: true})
+			p = p[2:]
+
+		case p[0] == '.':
+			end := strings.IndexAny(p[1:], ".[")
+			if end < 0 {
+				end = len(p) - 1
+			}
+			if end == 0 {
+				err = fmt.Errorf("Empty name in path %s", path)
+				return
+			}
+			steps = append(steps, pathStep{name: p[1 : end+1]})
+			p = p[end+1:]
+
+		case p[0] == '[':
+			end := strings.Index(p, "]")
+			if end < 0 {
+				err = fmt.Errorf("Unclosed [ in path %s", path)
+				return
+			}
+			inner := p[1:end]
+			p = p[end+1:]
+			switch {
+			case inner == "*":
+				steps = append(steps, pathStep{wildcard: true})
+
+			case len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0]:
+				steps = append(steps, pathStep{name: inner[1 : len(inner)-1]})
+
+			default:
+				i, e := strconv.Atoi(inner)
+				if e != nil {
+					err = fmt.Errorf("Invalid index [%s] in path %s", inner, path)
+					return
+				}
+				steps = append(steps, pathStep{index: i, isIndex: true})
+			}
+
+		default:
+			err = fmt.Errorf("Unexpected %q in path %s", p[0], path)
+			return
+		}
+	}
+	for _, s := range steps {
+		multiple = multiple || s.wildcard
+	}
+	return
+}
+
+// Returns every value in a decoded JSON document that the path matches.
+//
+func EvalPath(doc interface{}, steps []pathStep) (matches []interface{}) {
+	matches = []interface{}{doc}
+	for _, step := range steps {
+		var next []interface{}
+		for _, node := range matches {
+			switch n := node.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					for _, k := range sortedKeys(n) {
+						next = append(next, n[k])
+					}
+				} else if v, ok := n[step.name]; ok && !step.isIndex {
+					next = append(next, v)
+				}
+
+			case []interface{}:
+				if step.wildcard {
+					next = append(next, n...)
+				} else if step.isIndex {
+					i := step.index
+					if i < 0 {
+						i += len(n)
+					}
+					if i >= 0 && i < len(n) {
+						next = append(next, n[i])
+					}
+				}
+			}
+		}
+		matches = next
+	}
+	return
+}
+
+// Reads the part of a JSON document picked out by the "path" parameter.
+// Paths that can only match one value return it, or a 404 if nothing
+// matches; paths with wildcards return a list of everything they match.
+//
+func ReadDocumentPath(client redis.Conn, key, path string) (response R) {
+	steps, multiple, err := ParsePath(path)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	println("GET", key, path)
+	stored, err := redis.Bytes(client.Do("GET", key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	var doc interface{}
+	if err = decodeJSON(bytes.NewReader(stored), &doc); err != nil {
+		e := "The key does not hold a JSON document."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+
+	matches := EvalPath(doc, steps)
+	if multiple {
+		if matches == nil {
+			matches = []interface{}{}
+		}
+		response = R{"result": matches, "error": nil}
+		return
+	}
+	if len(matches) == 0 {
+		e := fmt.Sprintf("Nothing in the document matches %s.", path)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+		return
+	}
+	response = R{"result": matches[0], "error": nil}
+	return
+}
+
+// A single JSON Patch operation.
+//
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from"`
+	Value interface{} `json:"value"`
+}
+
+// Applies a JSON Patch to the JSON document stored in a string, atomically:
+// either every operation is applied, or (if one fails, or a "test" doesn't
+// hold) none are, and the response is a 409.
+//
+func patchJSONDocument(req *http.Request, client redis.Conn, key string) (response R) {
+	var ops []PatchOperation
+	if err := decodeJSON(req.Body, &ops); err != nil {
+		e := fmt.Sprintf("Could not decode the JSON Patch: %s", err)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	for attempt := 0; attempt < DocumentPatchAttempts; attempt++ {
+		retry := false
+		response, retry = updateDocument(client, key, func(doc interface{}) (interface{}, R) {
+			for i, op := range ops {
+				var err error
+				if doc, err = ApplyPatchOperation(doc, op); err != nil {
+					e := fmt.Sprintf("Operation %d (%s %s) failed: %s", i, op.Op, op.Path, err)
+					return nil, R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+				}
+			}
+			return doc, nil
+		})
+		if !retry {
+			return
+		}
+	}
+	e := "The document kept changing while it was being patched."
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+	return
+}
+
+// Applies one JSON Patch operation to a decoded document, returning the new
+// document.
+//
+func ApplyPatchOperation(doc interface{}, op PatchOperation) (result interface{}, err error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return
+	}
+	switch op.Op {
+	case "add":
+		result, err = pointerAdd(doc, path, copyJSON(op.Value))
+
+	case "remove":
+		result, err = pointerRemove(doc, path)
+
+	case "replace":
+		if _, err = pointerGet(doc, path); err != nil {
+			return
+		}
+		if result, err = pointerRemove(doc, path); err == nil {
+			result, err = pointerAdd(result, path, copyJSON(op.Value))
+		}
+
+	case "move", "copy":
+		var from []string
+		if from, err = parsePointer(op.From); err != nil {
+			return
+		}
+		var v interface{}
+		if v, err = pointerGet(doc, from); err != nil {
+			return
+		}
+		result = doc
+		if op.Op == "move" {
+			if strings.HasPrefix(op.Path+"/", op.From+"/") && op.Path != op.From {
+				err = errors.New("Cannot move a value into itself")
+				return
+			}
+			if result, err = pointerRemove(result, from); err != nil {
+				return
+			}
+		} else {
+			v = copyJSON(v)
+		}
+		result, err = pointerAdd(result, path, v)
+
+	case "test":
+		var v interface{}
+		if v, err = pointerGet(doc, path); err != nil {
+			return
+		}
+		if !jsonEqual(v, op.Value) {
+			err = errors.New("Test failed")
+			return
+		}
+		result = doc
+
+	default:
+		err = fmt.Errorf("Unknown operation %q", op.Op)
+	}
+	return
+}
+
+// Splits a JSON Pointer (RFC 6901) into its reference tokens.
+//
+func parsePointer(p string) (tokens []string, err error) {
+	if len(p) == 0 {
+		return
+	}
+	if p[0] != '/' {
+		err = fmt.Errorf("Invalid JSON Pointer %q", p)
+		return
+	}
+	for _, t := range strings.Split(p[1:], "/") {
+		t = strings.Replace(t, "~1", "/", -1)
+		t = strings.Replace(t, "~0", "~", -1)
+		tokens = append(tokens, t)
+	}
+	return
+}
+
+func arrayIndex(a []interface{}, token string, allowEnd bool) (i int, err error) {
+	if token == "-" && allowEnd {
+		i = len(a)
+		return
+	}
+	i, err = strconv.Atoi(token)
+	max := len(a) - 1
+	if allowEnd {
+		max = len(a)
+	}
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		err = fmt.Errorf("Invalid array index %q", token)
+	}
+	return
+}
+
+func pointerGet(doc interface{}, path []string) (v interface{}, err error) {
+	v = doc
+	for _, token := range path {
+		switch n := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = n[token]; !ok {
+				err = fmt.Errorf("No member %q", token)
+				return
+			}
+		case []interface{}:
+			var i int
+			if i, err = arrayIndex(n, token, false); err != nil {
+				return
+			}
+			v = n[i]
+		default:
+			err = fmt.Errorf("Cannot look up %q in a scalar", token)
+			return
+		}
+	}
+	return
+}
+
+// Calls change on the container holding the last token of the path, and
+// returns the document with the changed container put back in place.
+//
+func pointerChange(doc interface{}, path []string, change func(container interface{}, token string) (interface{}, error)) (result interface{}, err error) {
+	if len(path) == 1 {
+		result, err = change(doc, path[0])
+		return
+	}
+	child, err := pointerGet(doc, path[:1])
+	if err != nil {
+		return
+	}
+	if child, err = pointerChange(child, path[1:], change); err != nil {
+		return
+	}
+	switch n := doc.(type) {
+	case map[string]interface{}:
+		n[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(n, path[0], false)
+		n[i] = child
+	}
+	result = doc
+	return
+}
+
+func pointerAdd(doc interface{}, path []string, value interface{}) (result interface{}, err error) {
+	if len(path) == 0 {
+		result = value
+		return
+	}
+	result, err = pointerChange(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch n := container.(type) {
+		case map[string]interface{}:
+			n[token] = value
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(n, token, true)
+			if err != nil {
+				return nil, err
+			}
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = value
+			return n, nil
+		}
+		return nil, fmt.Errorf("Cannot add %q to a scalar", token)
+	})
+	return
+}
+
+func pointerRemove(doc interface{}, path []string) (result interface{}, err error) {
+	if len(path) == 0 {
+		err = errors.New("Cannot remove the whole document")
+		return
+	}
+	result, err = pointerChange(doc, path, func(container interface{}, token string) (interface{}, error) {
+		switch n := container.(type) {
+		case map[string]interface{}:
+			if _, ok := n[token]; !ok {
+				return nil, fmt.Errorf("No member %q", token)
+			}
+			delete(n, token)
+			return n, nil
+		case []interface{}:
+			i, err := arrayIndex(n, token, false)
+			if err != nil {
+				return nil, err
+			}
+			return append(n[:i], n[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("Cannot remove %q from a scalar", token)
+	})
+	return
+}
+
+// Returns a deep copy of a decoded JSON value, so patches can be applied
+// more than once without sharing state.
+//
+func copyJSON(v interface{}) (c interface{}) {
+	b, _ := json.Marshal(v)
+	decodeJSON(bytes.NewReader(b), &c)
+	return
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeDocument(t *testing.T, s string) (doc interface{}) {
+	if err := decodeJSON(strings.NewReader(s), &doc); err != nil {
+		t.Fatalf("Could not decode %s: %s", s, err)
+	}
+	return
+}
+
+func TestParsePointer(t *testing.T) {
+	tests := []struct {
+		pointer string
+		tokens  []string
+	}{
+		{"", nil},
+		{"/", []string{""}},
+		{"/a/b", []string{"a", "b"}},
+		{"/a~1b", []string{"a/b"}},
+		{"/m~0n", []string{"m~n"}},
+		{"/~01", []string{"~1"}},
+		{"/0/-", []string{"0", "-"}},
+	}
+	for _, test := range tests {
+		tokens, err := parsePointer(test.pointer)
+		if err != nil || !reflect.DeepEqual(tokens, test.tokens) {
+			t.Errorf("parsePointer(%q) = %q, %v, want %q", test.pointer, tokens, err, test.tokens)
+		}
+	}
+	if _, err := parsePointer("a/b"); err == nil {
+		t.Errorf("parsePointer(%q) succeeded", "a/b")
+	}
+}
+
+func TestPointerGet(t *testing.T) {
+	// The examples from RFC 6901, section 5.
+	//
+	doc := decodeDocument(t, `{"foo": ["bar", "baz"], "": 0, "a/b": 1, "c%d": 2,
+		"e^f": 3, "g|h": 4, "i\\j": 5, "k\"l": 6, " ": 7, "m~n": 8}`)
+	tests := []struct {
+		pointer string
+		value   string
+	}{
+		{"", ""},
+		{"/foo", `["bar","baz"]`},
+		{"/foo/0", `"bar"`},
+		{"/", "0"},
+		{"/a~1b", "1"},
+		{"/c%d", "2"},
+		{"/e^f", "3"},
+		{"/g|h", "4"},
+		{"/i\\j", "5"},
+		{"/k\"l", "6"},
+		{"/ ", "7"},
+		{"/m~0n", "8"},
+	}
+	for _, test := range tests {
+		path, _ := parsePointer(test.pointer)
+		v, err := pointerGet(doc, path)
+		if err != nil {
+			t.Errorf("pointerGet(%q) failed: %s", test.pointer, err)
+			continue
+		}
+		if test.pointer == "" {
+			continue
+		}
+		if b, _ := json.Marshal(v); string(b) != test.value {
+			t.Errorf("pointerGet(%q) = %s, want %s", test.pointer, b, test.value)
+		}
+	}
+	for _, pointer := range []string{"/missing", "/foo/2", "/foo/-", "/foo/01", "/foo/bar/baz"} {
+		path, _ := parsePointer(pointer)
+		if v, err := pointerGet(doc, path); err == nil {
+			t.Errorf("pointerGet(%q) = %v, want an error", pointer, v)
+		}
+	}
+}
+
+func TestApplyPatchOperation(t *testing.T) {
+	tests := []struct {
+		doc    string
+		op     PatchOperation
+		result string
+	}{
+		{`{"a": 1}`, PatchOperation{Op: "add", Path: "/b", Value: "x"}, `{"a":1,"b":"x"}`},
+		{`{"a": 1}`, PatchOperation{Op: "add", Path: "/a", Value: 2}, `{"a":2}`},
+		{`{"a": [1, 2]}`, PatchOperation{Op: "add", Path: "/a/1", Value: 3}, `{"a":[1,3,2]}`},
+		{`{"a": [1, 2]}`, PatchOperation{Op: "add", Path: "/a/-", Value: 3}, `{"a":[1,2,3]}`},
+		{`{"a": [1, 2]}`, PatchOperation{Op: "add", Path: "/a/2", Value: 3}, `{"a":[1,2,3]}`},
+		{`{"a": 1}`, PatchOperation{Op: "add", Path: "", Value: []interface{}{}}, `[]`},
+		{`{"a": 1, "b": 2}`, PatchOperation{Op: "remove", Path: "/a"}, `{"b":2}`},
+		{`[1, 2, 3]`, PatchOperation{Op: "remove", Path: "/1"}, `[1,3]`},
+		{`{"a": 1}`, PatchOperation{Op: "replace", Path: "/a", Value: nil}, `{"a":null}`},
+		{`{"a": {"b": 1}, "c": {}}`, PatchOperation{Op: "move", From: "/a/b", Path: "/c/d"}, `{"a":{},"c":{"d":1}}`},
+		{`{"a": [1, 2, 3]}`, PatchOperation{Op: "move", From: "/a/0", Path: "/a/-"}, `{"a":[2,3,1]}`},
+		{`{"a": {"b": 1}}`, PatchOperation{Op: "move", From: "/a", Path: "/a"}, `{"a":{"b":1}}`},
+		{`{"a": {"b": 1}}`, PatchOperation{Op: "copy", From: "/a", Path: "/c"}, `{"a":{"b":1},"c":{"b":1}}`},
+		{`{"a": [1, {"b": 2}]}`, PatchOperation{Op: "test", Path: "/a", Value: []interface{}{1.0, map[string]interface{}{"b": 2.0}}}, `{"a":[1,{"b":2}]}`},
+		{`{"a": 1.0}`, PatchOperation{Op: "test", Path: "/a", Value: json.Number("1")}, `{"a":1.0}`},
+		{`{"id": 12345678901234567891}`, PatchOperation{Op: "add", Path: "/n", Value: json.Number("98765432109876543210")}, `{"id":12345678901234567891,"n":98765432109876543210}`},
+	}
+	for _, test := range tests {
+		result, err := ApplyPatchOperation(decodeDocument(t, test.doc), test.op)
+		if err != nil {
+			t.Errorf("%s %+v failed: %s", test.doc, test.op, err)
+			continue
+		}
+		if b, _ := json.Marshal(result); string(b) != test.result {
+			t.Errorf("%s %+v = %s, want %s", test.doc, test.op, b, test.result)
+		}
+	}
+}
+
+func TestApplyPatchOperationFailures(t *testing.T) {
+	tests := []struct {
+		doc string
+		op  PatchOperation
+	}{
+		{`{"a": 1}`, PatchOperation{Op: "add", Path: "/b/c", Value: 1}},
+		{`{"a": [1]}`, PatchOperation{Op: "add", Path: "/a/3", Value: 1}},
+		{`{"a": [1]}`, PatchOperation{Op: "add", Path: "/a/x", Value: 1}},
+		{`{"a": 1}`, PatchOperation{Op: "remove", Path: "/b"}},
+		{`{"a": [1]}`, PatchOperation{Op: "remove", Path: "/a/-"}},
+		{`{"a": 1}`, PatchOperation{Op: "replace", Path: "/b", Value: 1}},
+		{`{"a": {"b": 1}}`, PatchOperation{Op: "move", From: "/a", Path: "/a/b/c"}},
+		{`{"a": {"b": 1}}`, PatchOperation{Op: "move", From: "/a", Path: "/a/c"}},
+		{`{"a": 1}`, PatchOperation{Op: "move", From: "/b", Path: "/c"}},
+		{`{"a": 1}`, PatchOperation{Op: "copy", From: "/b", Path: "/c"}},
+		{`{"a": 1}`, PatchOperation{Op: "test", Path: "/a", Value: "1"}},
+		{`{"a": [1, 2]}`, PatchOperation{Op: "test", Path: "/a", Value: []interface{}{2.0, 1.0}}},
+		{`{"a": 1}`, PatchOperation{Op: "test", Path: "/b", Value: nil}},
+		{`{"a": 1}`, PatchOperation{Op: "frobnicate", Path: "/a"}},
+		{`{"a": 1}`, PatchOperation{Op: "add", Path: "a", Value: 1}},
+	}
+	for _, test := range tests {
+		doc := decodeDocument(t, test.doc)
+		if result, err := ApplyPatchOperation(doc, test.op); err == nil {
+			b, _ := json.Marshal(result)
+			t.Errorf("%s %+v = %s, want an error", test.doc, test.op, b)
+		}
+		if b, _ := json.Marshal(doc); string(b) != string(mustCompact(t, test.doc)) {
+			t.Errorf("%s %+v changed the document to %s", test.doc, test.op, b)
+		}
+	}
+}
+
+func mustCompact(t *testing.T, s string) []byte {
+	b, err := json.Marshal(decodeDocument(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples from RFC 7396, appendix A.
+	//
+	tests := []struct{ doc, patch, result string }{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"a":"foo"}`, `null`, `null`},
+		{`{"a":"foo"}`, `"bar"`, `"bar"`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	}
+	for _, test := range tests {
+		result := MergePatch(decodeDocument(t, test.doc), decodeDocument(t, test.patch))
+		if b, _ := json.Marshal(result); string(b) != test.result {
+			t.Errorf("MergePatch(%s, %s) = %s, want %s", test.doc, test.patch, b, test.result)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+// format.go
+//
+// Content negotiation, and the functions used to write a response in the
+// format the client asked for.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	FormatJSON    = "json"
+	FormatMsgpack = "msgpack"
+	FormatCSV     = "csv"
+	FormatNDJSON  = "ndjson"
+	FormatRaw     = "raw"
+)
+
+// The key in an R that holds the HTTP status code a response should be sent
+// with. It is removed before the response is encoded.
+//
+const statusKey = "_status"
+
+var (
+	// Maps the media types accepted in an "Accept" header to the format
+	// that will be used to write the response.
+	//
+	mediaTypes = map[string]string{
+		"application/json":         FormatJSON,
+		"application/*":            FormatJSON,
+		"*/*":                      FormatJSON,
+		"application/msgpack":      FormatMsgpack,
+		"application/x-msgpack":    FormatMsgpack,
+		"text/csv":                 FormatCSV,
+		"application/x-ndjson":     FormatNDJSON,
+		"application/ndjson":       FormatNDJSON,
+		"application/octet-stream": FormatRaw,
+	}
+
+	// The "Content-Type" each format is sent with.
+	//
+	contentTypes = map[string]string{
+		FormatJSON:    "application/json",
+		FormatMsgpack: "application/msgpack",
+		FormatCSV:     "text/csv; charset=utf-8",
+		FormatNDJSON:  "application/x-ndjson",
+		FormatRaw:     "application/octet-stream",
+	}
+
+	errNotTabular = errors.New("CSV output is only available for lists, sets, sorted sets and hashes.")
+	errNotRaw     = errors.New("Raw output is only available for string keys.")
+)
+
+// Sets the HTTP status code the response will be written with.
+//
+func (r R) WithStatus(code int) R {
+	r[statusKey] = code
+	return r
+}
+
+// Returns the HTTP status code the response should be written with. Unless
+// a handler says otherwise, that is 200, even for errors; the "error" field
+// is what tells the client something went wrong.
+//
+func (r R) Status() (code int) {
+	code = http.StatusOK
+	if c, ok := r[statusKey].(int); ok {
+		code = c
+	}
+	return
+}
+
+// Works out which format the response should be written in. An explicit
+// "format" parameter wins; otherwise the "Accept" header is consulted, and
+// the supported media type with the highest quality is picked. Anything
+// Scarlet does not understand falls back to JSON.
+//
+func NegotiateFormat(req *http.Request) (format string, err error) {
+	if f := req.FormValue("format"); len(f) > 0 {
+		if _, ok := contentTypes[f]; !ok {
+			err = fmt.Errorf("Unsupported format: %s", f)
+			return
+		}
+		format = f
+		return
+	}
+
+	format = FormatJSON
+	best := 0.0
+	for _, part := range strings.Split(req.Header.Get("Accept"), ",") {
+		mt, params, e := mime.ParseMediaType(strings.TrimSpace(part))
+		if e != nil {
+			continue
+		}
+		f, ok := mediaTypes[mt]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		if qv, ok := params["q"]; ok {
+			if q, e = strconv.ParseFloat(qv, 64); e != nil {
+				continue
+			}
+		}
+		if q > best {
+			best = q
+			format = f
+		}
+	}
+	return
+}
+
+// Writes the response to the client, in the format negotiated from the
+// request.
+//
+func WriteResponse(rw http.ResponseWriter, req *http.Request, response R) {
+	format, err := NegotiateFormat(req)
+	if err != nil {
+		format = FormatJSON
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusNotAcceptable)
+	}
+	status := response.Status()
+	delete(response, statusKey)
+	if format != FormatRaw {
+		EncodeResult(rw, req, format, response)
+	}
+
+	var body []byte
+	switch format {
+	case FormatMsgpack:
+		body, err = MarshalMsgpack(map[string]interface{}(response))
+
+	case FormatCSV:
+		body, err = encodeCSV(response)
+
+	case FormatNDJSON:
+		body, err = encodeNDJSON(response)
+
+	case FormatRaw:
+		body, err = encodeRaw(response)
+
+	default:
+		body = []byte(response.String())
+	}
+
+	if err != nil {
+		// Errors can't be represented in CSV, or as raw bytes, so send them
+		// as plain text instead.
+		//
+		if status == http.StatusOK {
+			status = http.StatusNotAcceptable
+			if responseError(response) != nil {
+				status = http.StatusBadRequest
+			}
+		}
+		http.Error(rw, fmt.Sprintf("%s", err), status)
+		return
+	}
+
+	rw.Header().Set("Content-Type", contentTypes[format])
+	rw.WriteHeader(status)
+	rw.Write(body)
+	return
+}
+
+// Returns the value of the "error" field of a response as an error, if it is
+// set.
+//
+func responseError(response R) (err error) {
+	switch e := response["error"].(type) {
+	case nil:
+	case error:
+		err = e
+	case string:
+		err = errors.New(e)
+	default:
+		err = fmt.Errorf("%v", e)
+	}
+	return
+}
+
+// Writes the result of a response as CSV: one row per element of a list, set
+// or sorted set, or one "field,value" row per field of a hash.
+//
+func encodeCSV(response R) (b []byte, err error) {
+	if err = responseError(response); err != nil {
+		return
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	v := reflect.ValueOf(response["result"])
+	switch {
+	case !v.IsValid():
+		err = errNotTabular
+		return
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		for i := 0; i < v.Len(); i++ {
+			w.Write(csvRecord(v.Index(i).Interface()))
+		}
+
+	case v.Kind() == reflect.Map:
+		keys := sortedMapKeys(v)
+		for _, k := range keys {
+			w.Write(append([]string{csvField(k.Interface())},
+				csvRecord(v.MapIndex(k).Interface())...))
+		}
+
+	default:
+		err = errNotTabular
+		return
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return
+	}
+	b = buf.Bytes()
+	return
+}
+
+func csvRecord(x interface{}) (record []string) {
+	v := reflect.ValueOf(x)
+	if v.IsValid() && v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8 {
+		for i := 0; i < v.Len(); i++ {
+			record = append(record, csvField(v.Index(i).Interface()))
+		}
+		return
+	}
+	record = []string{csvField(x)}
+	return
+}
+
+func csvField(x interface{}) (s string) {
+	switch t := x.(type) {
+	case nil:
+	case []byte:
+		s = string(t)
+	default:
+		s = fmt.Sprint(t)
+	}
+	return
+}
+
+// Writes the result of a response as newline-delimited JSON: one line per
+// element of a list, set or sorted set, or one {"key":...,"value":...} object
+// per field of a hash. Any other response is written as a single line.
+//
+func encodeNDJSON(response R) (b []byte, err error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	v := reflect.ValueOf(response["result"])
+	switch {
+	case response["error"] != nil || !v.IsValid():
+		buf.WriteString(response.String())
+		buf.WriteByte('\n')
+
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		for i := 0; i < v.Len(); i++ {
+			if err = enc.Encode(v.Index(i).Interface()); err != nil {
+				return
+			}
+		}
+
+	case v.Kind() == reflect.Map:
+		for _, k := range sortedMapKeys(v) {
+			line := R{"key": k.Interface(), "value": v.MapIndex(k).Interface()}
+			if err = enc.Encode(line); err != nil {
+				return
+			}
+		}
+
+	default:
+		buf.WriteString(response.String())
+		buf.WriteByte('\n')
+	}
+	b = buf.Bytes()
+	return
+}
+
+// Returns the value of a string key as-is, so stored blobs can be served
+// directly.
+//
+func encodeRaw(response R) (b []byte, err error) {
+	if err = responseError(response); err != nil {
+		return
+	}
+	switch t := response["result"].(type) {
+	case string:
+		b = []byte(t)
+	case []byte:
+		b = t
+	default:
+		err = errNotRaw
+	}
+	return
+}
+
+func sortedMapKeys(v reflect.Value) (keys []reflect.Value) {
+	keys = v.MapKeys()
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+	})
+	return
+}
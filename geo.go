@@ -0,0 +1,350 @@
+// geo.go
+//
+// Geospatial indexes: adding locations, looking them up, measuring between
+// them and searching around a point, with results as GeoJSON.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Operations["geoadd"] = Operation{Methods: []string{"POST"}, Handler: HandleGeoAdd}
+	Operations["geopos"] = Operation{Methods: []string{"GET"}, Handler: HandleGeoPos}
+	Operations["geodist"] = Operation{Methods: []string{"GET"}, Handler: HandleGeoDist}
+	Operations["geosearch"] = Operation{Methods: []string{"GET"}, Handler: HandleGeoSearch}
+	return
+}
+
+type GeoPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type GeoFeature struct {
+	Type       string                 `json:"type"`
+	ID         string                 `json:"id"`
+	Geometry   GeoPoint               `json:"geometry"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type GeoFeatureCollection struct {
+	Type     string       `json:"type"`
+	Features []GeoFeature `json:"features"`
+}
+
+func NewFeature(member string, lon, lat float64) GeoFeature {
+	return GeoFeature{
+		Type:       "Feature",
+		ID:         member,
+		Geometry:   GeoPoint{Type: "Point", Coordinates: [2]float64{lon, lat}},
+		Properties: map[string]interface{}{},
+	}
+}
+
+func NewFeatureCollection() *GeoFeatureCollection {
+	return &GeoFeatureCollection{Type: "FeatureCollection", Features: []GeoFeature{}}
+}
+
+var geoUnits = map[string]bool{"m": true, "km": true, "mi": true, "ft": true}
+
+// Returns the "unit" parameter, which defaults to meters.
+//
+func geoUnit(req *http.Request) (unit string, response R) {
+	unit = strings.ToLower(req.FormValue("unit"))
+	if len(unit) == 0 {
+		unit = "m"
+	}
+	if !geoUnits[unit] {
+		e := "The \"unit\" parameter must be one of m, km, mi or ft."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+// Parses the float parameters named, all of which must be given.
+//
+func floatParams(req *http.Request, names ...string) (values []float64, response R) {
+	for _, name := range names {
+		f, err := strconv.ParseFloat(req.FormValue(name), 64)
+		if err != nil {
+			e := fmt.Sprintf("The %q parameter must be a number.", name)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		values = append(values, f)
+	}
+	return
+}
+
+// Handles POST /{db}/{key}/geoadd, adding locations to a geo set. The body
+// is a GeoJSON Feature or FeatureCollection of Points, each with an "id"
+// naming the member; or, without a JSON body, a single location is given
+// with the "member", "lon" and "lat" parameters. The result is the number of
+// members that were new.
+//
+func HandleGeoAdd(req *http.Request, info *RequestInfo) (response R) {
+	args := redis.Args{}.Add(info.Key)
+	if isJSON(req) {
+		var body struct {
+			Type     string       `json:"type"`
+			ID       string       `json:"id"`
+			Geometry GeoPoint     `json:"geometry"`
+			Features []GeoFeature `json:"features"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+			e := fmt.Sprintf("Could not decode the GeoJSON: %s", err)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		features := body.Features
+		if body.Type == "Feature" {
+			features = []GeoFeature{{ID: body.ID, Geometry: body.Geometry}}
+		}
+		for _, f := range features {
+			if f.Geometry.Type != "Point" || len(f.ID) == 0 {
+				e := "Every feature must be a Point, with an id."
+				response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+				return
+			}
+			args = args.Add(f.Geometry.Coordinates[0], f.Geometry.Coordinates[1], f.ID)
+		}
+	} else {
+		member := req.FormValue("member")
+		coords, response := floatParams(req, "lon", "lat")
+		if response != nil {
+			return response
+		}
+		if len(member) == 0 {
+			e := "Missing required parameter: member."
+			return R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		}
+		args = args.Add(coords[0], coords[1], member)
+	}
+	if len(args) == 1 {
+		response = R{"result": nil, "error": "No locations provided."}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("GEOADD", info.Key, (len(args)-1)/3, "locations")
+	n, err := redis.Int64(client.Do("GEOADD", args...))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
+
+// Parses a [longitude, latitude] pair from a reply.
+//
+func geoCoords(reply interface{}) (lon, lat float64, ok bool) {
+	pos, err := redis.Values(reply, nil)
+	if err != nil || len(pos) != 2 {
+		return
+	}
+	lon, err = redis.Float64(pos[0], nil)
+	if err != nil {
+		return
+	}
+	lat, err = redis.Float64(pos[1], nil)
+	ok = err == nil
+	return
+}
+
+// Handles GET /{db}/{key}/geopos?member={m}, returning the locations of the
+// members as a FeatureCollection. Members that aren't in the set are left
+// out.
+//
+func HandleGeoPos(req *http.Request, info *RequestInfo) (response R) {
+	req.ParseForm()
+	members := req.Form["member"]
+	if len(members) == 0 {
+		e := "Missing required parameter: member."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	response = GeoFeatures(client, info.Key, members)
+	return
+}
+
+// Looks up the locations of the members of a geo set, and returns them as a
+// FeatureCollection.
+//
+func GeoFeatures(client redis.Conn, key string, members []string) (response R) {
+	fc := NewFeatureCollection()
+	if len(members) > 0 {
+		println("GEOPOS", key, len(members), "members")
+		positions, err := redis.Values(client.Do("GEOPOS", redis.Args{}.Add(key).AddFlat(members)...))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		for i, p := range positions {
+			if lon, lat, ok := geoCoords(p); ok && i < len(members) {
+				fc.Features = append(fc.Features, NewFeature(members[i], lon, lat))
+			}
+		}
+	}
+	response = R{"result": fc, "error": nil}
+	return
+}
+
+// Handles GET /{db}/{key}/geodist?member={a}&member={b}, returning the
+// distance between two members in the given "unit", or a 404 if either of
+// them is missing.
+//
+func HandleGeoDist(req *http.Request, info *RequestInfo) (response R) {
+	req.ParseForm()
+	members := req.Form["member"]
+	if len(members) != 2 {
+		e := "Give exactly two \"member\" parameters."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	unit, response := geoUnit(req)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("GEODIST", info.Key, members[0], members[1], unit)
+	d, err := redis.Float64(client.Do("GEODIST", info.Key, members[0], members[1], unit))
+	if err == redis.ErrNil {
+		e := "One of the members is not in the set."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": d, "unit": unit, "error": nil}
+	return
+}
+
+// Handles GET /{db}/{key}/geosearch, finding the members around a center
+// point, given by "lon" and "lat" or by an existing "member", within a
+// "radius", or a box of "width" by "height", in the given "unit". Results
+// are sorted nearest first (or, with "sort=desc", farthest first), limited
+// to "count" if given, and returned as a FeatureCollection, with each
+// member's distance from the center in its properties.
+//
+// Box searches need Redis 6.2 or later; radius searches fall back to
+// GEORADIUS on older servers.
+//
+func HandleGeoSearch(req *http.Request, info *RequestInfo) (response R) {
+	unit, response := geoUnit(req)
+	if response != nil {
+		return
+	}
+
+	var from, radiusFrom, shape redis.Args
+	if member := req.FormValue("member"); len(member) > 0 {
+		from = redis.Args{}.Add("FROMMEMBER", member)
+		radiusFrom = redis.Args{}.Add(member)
+	} else {
+		coords, response := floatParams(req, "lon", "lat")
+		if response != nil {
+			return response
+		}
+		from = redis.Args{}.Add("FROMLONLAT", coords[0], coords[1])
+		radiusFrom = redis.Args{}.Add(coords[0], coords[1])
+	}
+	if len(req.FormValue("radius")) > 0 {
+		r, response := floatParams(req, "radius")
+		if response != nil {
+			return response
+		}
+		shape = redis.Args{}.Add("BYRADIUS", r[0], unit)
+	} else {
+		box, response := floatParams(req, "width", "height")
+		if response != nil {
+			return response
+		}
+		shape = redis.Args{}.Add("BYBOX", box[0], box[1], unit)
+	}
+
+	order := "ASC"
+	if strings.ToLower(req.FormValue("sort")) == "desc" {
+		order = "DESC"
+	}
+	options := redis.Args{}.Add(order)
+	if c := req.FormValue("count"); len(c) > 0 {
+		n, err := strconv.Atoi(c)
+		if err != nil || n <= 0 {
+			e := fmt.Sprintf("Invalid count: %s", c)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		options = options.Add("COUNT", n)
+	}
+	options = options.Add("WITHCOORD", "WITHDIST")
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("GEOSEARCH", info.Key)
+	args := append(append(append(redis.Args{}.Add(info.Key), from...), shape...), options...)
+	results, err := redis.Values(client.Do("GEOSEARCH", args...))
+	if unknownCommand(err) {
+		if shape[0] != "BYRADIUS" {
+			e := "Searching within a box needs Redis 6.2 or later."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusNotImplemented)
+			return
+		}
+		cmd := "GEORADIUS"
+		if from[0] == "FROMMEMBER" {
+			cmd = "GEORADIUSBYMEMBER"
+		}
+		args = append(append(redis.Args{}.Add(info.Key), radiusFrom...), shape[1:]...)
+		results, err = redis.Values(client.Do(cmd, append(args, options...)...))
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+
+	// Each result is [member, distance, [lon, lat]].
+	//
+	fc := NewFeatureCollection()
+	for _, r := range results {
+		item, err := redis.Values(r, nil)
+		if err != nil || len(item) < 3 {
+			continue
+		}
+		member, _ := redis.String(item[0], nil)
+		dist, _ := redis.Float64(item[1], nil)
+		lon, lat, ok := geoCoords(item[2])
+		if !ok {
+			continue
+		}
+		f := NewFeature(member, lon, lat)
+		f.Properties["distance"] = dist
+		f.Properties["unit"] = unit
+		fc.Features = append(fc.Features, f)
+	}
+	response = R{"result": fc, "error": nil}
+	return
+}
@@ -0,0 +1,308 @@
+// hash.go
+//
+// Field-level operations on hashes: checking for, counting, listing,
+// scanning and expiring fields, and setting a field only if it is new. Most
+// of them also work on the other key types, where that makes sense.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Operations["exists"] = Operation{Methods: []string{"GET"}, Handler: HandleExists}
+	Operations["len"] = Operation{Methods: []string{"GET"}, Handler: HandleLen}
+	Operations["keys"] = Operation{Methods: []string{"GET"}, Handler: HandleHashKeys}
+	Operations["vals"] = Operation{Methods: []string{"GET"}, Handler: HandleHashKeys}
+	Operations["setnx"] = Operation{Methods: []string{"POST"}, Handler: HandleHashSetNX}
+	Operations["scan"] = Operation{Methods: []string{"GET"}, Handler: HandleScan}
+	Operations["expire"] = Operation{Methods: []string{"POST"}, Handler: HandleExpire}
+	Operations["ttl"] = Operation{Methods: []string{"GET"}, Handler: HandleTTL}
+	return
+}
+
+// Handles GET /{db}/{key}/exists: whether the key exists, or, with "field",
+// whether the hash has that field.
+//
+func HandleExists(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	var exists bool
+	if field := req.FormValue("field"); len(field) > 0 {
+		println("HEXISTS", info.Key, field)
+		exists, err = redis.Bool(client.Do("HEXISTS", info.Key, field))
+	} else {
+		println("EXISTS", info.Key)
+		exists, err = redis.Bool(client.Do("EXISTS", info.Key))
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": exists, "error": nil}
+	return
+}
+
+// Handles GET /{db}/{key}/len: the number of fields in a hash (or elements
+// in a list, set or sorted set, or bytes in a string). Missing keys have a
+// length of zero.
+//
+func HandleLen(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	if keytype == "none" {
+		response = R{"result": 0, "error": nil}
+		return
+	}
+	cmd, ok := lengthCommands[keytype]
+	if keytype == "string" {
+		cmd, ok = "STRLEN", true
+	}
+	if !ok {
+		e := fmt.Sprintf("Cannot take the length of a %s.", keytype)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+	println(cmd, info.Key)
+	n, err := redis.Int64(client.Do(cmd, info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
+
+// Handles GET /{db}/{key}/keys and /vals, listing a hash's field names or
+// values.
+//
+func HandleHashKeys(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	cmd := "HKEYS"
+	if info.Op == "vals" {
+		cmd = "HVALS"
+	}
+	println(cmd, info.Key)
+	r, err := redis.Strings(client.Do(cmd, info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": r, "error": nil}
+	return
+}
+
+// Handles POST /{db}/{key}/setnx?field={f}, setting a hash field only if it
+// doesn't exist yet. Responds with a 201, or a 409 if the field exists.
+//
+func HandleHashSetNX(req *http.Request, info *RequestInfo) (response R) {
+	field := req.FormValue("field")
+	if len(field) == 0 {
+		e := "Missing required parameter: field."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	value, err := RequestValue(req)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("HSETNX", info.Key, field)
+	set, err := redis.Bool(client.Do("HSETNX", info.Key, field, value))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	if !set {
+		e := fmt.Sprintf("Field %s already exists.", field)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+	response = R{"result": true, "error": nil}.WithStatus(http.StatusCreated)
+	return
+}
+
+// Handles GET /{db}/{key}/scan, returning one batch of a hash's fields (or a
+// set's members, or a sorted set's members and scores) matching the "match"
+// pattern. Pass the returned cursor back as "cursor" to get the next batch;
+// a cursor of "0" means there are no more.
+//
+func HandleScan(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	cmd := map[string]string{"hash": "HSCAN", "set": "SSCAN", "zset": "ZSCAN"}[keytype]
+	if len(cmd) == 0 {
+		e := fmt.Sprintf("Cannot scan a %s.", keytype)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+
+	cursor := req.FormValue("cursor")
+	if len(cursor) == 0 {
+		cursor = "0"
+	}
+	args := redis.Args{}.Add(info.Key, cursor)
+	if match := req.FormValue("match"); len(match) > 0 {
+		args = args.Add("MATCH", match)
+	}
+	if count := req.FormValue("count"); len(count) > 0 {
+		n, err := strconv.Atoi(count)
+		if err != nil || n <= 0 {
+			e := fmt.Sprintf("Invalid count: %s", count)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		args = args.Add("COUNT", n)
+	}
+
+	println(cmd, info.Key, cursor)
+	reply, err := redis.Values(client.Do(cmd, args...))
+	if err == nil && len(reply) != 2 {
+		err = fmt.Errorf("Unexpected reply to %s", cmd)
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	next, _ := redis.String(reply[0], nil)
+	var items interface{}
+	if keytype == "set" {
+		items, err = redis.Strings(reply[1], nil)
+	} else {
+		items, err = redis.StringMap(reply[1], nil)
+	}
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	response = R{"result": items, "cursor": next, "error": nil}
+	return
+}
+
+// Handles POST /{db}/{key}/expire?ttl={seconds}. With one or more "field"
+// parameters, only those fields of the hash expire, which needs Redis 7.4 or
+// later; the result then lists what happened to each field, as HEXPIRE
+// reports it (1 if set, -2 if there is no such field).
+//
+func HandleExpire(req *http.Request, info *RequestInfo) (response R) {
+	ttl, err := strconv.ParseInt(req.FormValue("ttl"), 10, 64)
+	if err != nil || ttl <= 0 {
+		e := "The \"ttl\" parameter must be a positive number of seconds."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	req.ParseForm()
+	fields := req.Form["field"]
+	if len(fields) == 0 {
+		println("EXPIRE", info.Key, ttl)
+		set, err := redis.Bool(client.Do("EXPIRE", info.Key, ttl))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		if !set {
+			response = R{"result": nil, "error": "Key does not exist."}.WithStatus(http.StatusNotFound)
+			return
+		}
+		response = R{"result": true, "error": nil}
+		return
+	}
+
+	println("HEXPIRE", info.Key, ttl, strings.Join(fields, " "))
+	args := redis.Args{}.Add(info.Key, ttl, "FIELDS", len(fields)).AddFlat(fields)
+	codes, err := redis.Ints(client.Do("HEXPIRE", args...))
+	response = fieldResults(fields, codes, err)
+	return
+}
+
+// Handles GET /{db}/{key}/ttl: the seconds left before the key expires, or
+// with "field" parameters, before each of those hash fields expires. As with
+// TTL, -1 means no expiry is set, and -2 that there is no such key or field.
+//
+func HandleTTL(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	req.ParseForm()
+	fields := req.Form["field"]
+	if len(fields) == 0 {
+		println("TTL", info.Key)
+		ttl, err := redis.Int64(client.Do("TTL", info.Key))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		response = R{"result": ttl, "error": nil}
+		return
+	}
+
+	println("HTTL", info.Key, strings.Join(fields, " "))
+	args := redis.Args{}.Add(info.Key, "FIELDS", len(fields)).AddFlat(fields)
+	ttls, err := redis.Ints(client.Do("HTTL", args...))
+	response = fieldResults(fields, ttls, err)
+	return
+}
+
+// Maps each field to the number Redis replied with for it.
+//
+func fieldResults(fields []string, values []int, err error) (response R) {
+	if unknownCommand(err) {
+		e := "Per-field expiry needs Redis 7.4 or later."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotImplemented)
+		return
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	result := make(map[string]int)
+	for i, f := range fields {
+		if i < len(values) {
+			result[f] = values[i]
+		}
+	}
+	response = R{"result": result, "error": nil}
+	return
+}
@@ -3,25 +3,33 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
 	"net/http"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	urlRegex         = regexp.MustCompile("^/([0-9]{1,2})(/(.+))?(/(ttl|type))?")
+	urlRegex         = regexp.MustCompile("^/(([A-Za-z][A-Za-z0-9_-]*)/)?([0-9]{1,2})(/(.+))?")
 	querystringRegex = regexp.MustCompile(`(\?.*)$`)
 )
 
 func startHttp(listenAddr string) {
 	// URL-to-handler func mappings
 	//
-	http.HandleFunc("/info", GetInformation)
+	http.HandleFunc("/info", WithHeaders(GetInformation))
+	http.HandleFunc("/_admin/readonly", WithHeaders(ReadOnlyHandler))
+	http.HandleFunc("/_admin/webhooks", WithHeaders(WebhooksHandler))
+	http.HandleFunc("/_queues/", WithHeaders(QueueHandler))
+	http.HandleFunc("/_locks/", WithHeaders(LockHandler))
+	http.HandleFunc("/_schedule/", WithHeaders(ScheduleHandler))
 	http.HandleFunc("/favicon.ico", Favicon)
-	http.HandleFunc("/", DispatchRequest)
+	http.HandleFunc("/", WithHeaders(DispatchRequest))
 
 	// Start listening for requests
 	//
@@ -30,27 +38,150 @@ func startHttp(listenAddr string) {
 	return
 }
 
+// Returns the INFO of an upstream; the default one, unless another is named
+// with the "upstream" parameter.
+//
 func GetInformation(rw http.ResponseWriter, req *http.Request) {
-	rw.Header().Set("Content-Type", "application/json")
 	var response R
-	config, _ := LoadConfig(*configPath)
-	if config.Redis.InfoDisabled() {
+	upstream := req.FormValue("upstream")
+	cm, block, ok := Upstream(upstream)
+	if !ok {
+		e := fmt.Sprintf("Unknown upstream: %s", upstream)
+		response = R{"result": nil, "error": e}
+		WriteResponse(rw, req, response.WithStatus(http.StatusNotFound))
+		return
+	}
+	if response, denied := CheckACL(req, upstream, false); denied {
+		WriteResponse(rw, req, response)
+		return
+	}
+	if block.InfoDisabled() {
 		e := "Retrieving node information has been disabled."
 		response = R{"result": nil, "error": e}
-		fmt.Fprint(rw, response)
+		WriteResponse(rw, req, response)
+		return
+	}
+	println("INFO", upstream)
+	redisClient, err := cm.DB(0)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		WriteResponse(rw, req, response)
 		return
 	}
-	println("INFO")
-	redisClient, err := Database.DB(0)
 	info, err := GetHostInfo(redisClient)
-	response = R{"result": info, "error": err}
-	fmt.Fprint(rw, response)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+	} else {
+		response = R{"result": info, "error": nil}
+	}
+	WriteResponse(rw, req, response)
+	return
+}
+
+// The header (or, failing that, the query parameter) clients identify
+// themselves with.
+//
+const (
+	APIKeyHeader = "X-API-Key"
+	APIKeyParam  = "apiKey"
+)
+
+// Returns the API key the client sent with the request, if any.
+//
+func APIKey(req *http.Request) (key string) {
+	key = req.Header.Get(APIKeyHeader)
+	if len(key) == 0 {
+		key = req.FormValue(APIKeyParam)
+	}
 	return
 }
 
 type RequestInfo struct {
-	DbNum int
-	Key   string
+	Upstream string
+	DbNum    int
+	Key      string
+	Op       string
+	Tenant   *TenantBlock
+	ctx      context.Context
+
+	// The connection the request took from its upstream's pool, if it has
+	// taken one yet.
+	//
+	conn redis.Conn
+}
+
+// Returns the Redis client for the database the request is for. The client
+// stops issuing commands once the request's context is done, and, if the
+// request belongs to a tenant, only sees the tenant's keys.
+//
+func (info *RequestInfo) DB() (client redis.Conn, err error) {
+	if info.conn == nil {
+		cm, _, ok := Upstream(info.Upstream)
+		if !ok {
+			err = fmt.Errorf("Unknown upstream: %s", info.Upstream)
+			return
+		}
+		if info.conn, err = cm.Get(info.DbNum); err != nil {
+			return
+		}
+	}
+	client = info.wrap(info.conn)
+	return
+}
+
+// Puts the request's connection back in the pool. Call this once the request
+// is done with Redis.
+//
+func (info *RequestInfo) Close() {
+	if info.conn != nil {
+		info.conn.Close()
+		info.conn = nil
+	}
+	return
+}
+
+// Like DB, but returns a connection of the request's own, for commands that
+// need one to themselves, like MULTI and WATCH. The caller must close it.
+//
+func (info *RequestInfo) DedicatedDB() (client redis.Conn, err error) {
+	client, err = info.BlockingDB(0)
+	return
+}
+
+// Like DedicatedDB, for blocking commands: the connection's read timeout is
+// extended by wait, so a command that blocks for that long isn't cut off.
+//
+func (info *RequestInfo) BlockingDB(wait time.Duration) (client redis.Conn, err error) {
+	cm, _, ok := Upstream(info.Upstream)
+	if !ok {
+		err = fmt.Errorf("Unknown upstream: %s", info.Upstream)
+		return
+	}
+	conn, err := cm.DialBlocking(info.DbNum, wait)
+	if err != nil {
+		return
+	}
+	client = info.wrap(conn)
+	return
+}
+
+func (info *RequestInfo) wrap(conn redis.Conn) (client redis.Conn) {
+	if info.Tenant != nil {
+		conn = tenantConn{Conn: conn, prefix: info.Tenant.Prefix}
+	}
+	client = contextConn{Conn: conn, ctx: info.ctx}
+	return
+}
+
+// Returns the name the request's database goes by in the configuration: "3"
+// for the default upstream, or "{upstream}/3".
+//
+func (info *RequestInfo) DatabaseName() (name string) {
+	name = strconv.Itoa(info.DbNum)
+	if len(info.Upstream) > 0 {
+		name = info.Upstream + "/" + name
+	}
+	return
 }
 
 func GetRequestInfo(r *http.Request) (ri *RequestInfo, err error) {
@@ -60,47 +191,127 @@ func GetRequestInfo(r *http.Request) (ri *RequestInfo, err error) {
 		err = errors.New("Malformed URL")
 		return
 	}
-	dbnum, e := strconv.Atoi(strings.TrimLeft(m[1], "/"))
+	if _, _, ok := Upstream(m[2]); !ok {
+		err = fmt.Errorf("Unknown upstream: %s", m[2])
+		return
+	}
+	dbnum, err := strconv.Atoi(strings.TrimLeft(m[3], "/"))
 	if err != nil {
-		err = e
 		return
 	}
-	ri = &RequestInfo{DbNum: dbnum, Key: m[3]}
+	key, op := SplitOperation(r, m[5])
+	ri = &RequestInfo{
+		Upstream: m[2],
+		DbNum:    dbnum,
+		Key:      key,
+		Op:       op,
+		Tenant:   TenantFor(r),
+		ctx:      r.Context(),
+	}
 	return
 }
 
 func RootHandler() (response R) {
-	response = R{"result": R{"databases": Database.NConnections()},
+	upstreams := make(R)
+	for name, cm := range Upstreams {
+		upstreams[name] = R{"databases": cm.NConnections()}
+	}
+	response = R{"result": R{"databases": Database.NConnections(), "upstreams": upstreams},
 		"error": nil}
 	return
 }
 
 // Dispatches the incoming request to the proper action handler, depending on
-// the HTTP method that was used.
+// the HTTP method that was used. The handler has until the request's deadline
+// to finish.
 //
 func DispatchRequest(rw http.ResponseWriter, req *http.Request) {
+	timeout, err := RequestDeadline(req)
+	if err != nil {
+		response := R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		WriteResponse(rw, req, response.WithStatus(http.StatusBadRequest))
+		return
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
 	var response R
 	if req.URL.String() == "/" {
 		response = RootHandler()
 	} else if info, err := GetRequestInfo(req); err == nil {
-		switch req.Method {
-		case "GET":
-			response = HandleReadOperation(req, info)
+		if response, denied := CheckRequest(rw, req, info); denied {
+			WriteResponse(rw, req, response)
+			return
+		}
+		if config.Schedule.Enabled && IsScheduled(req) {
+			WriteResponse(rw, req, ScheduleRequest(req, info))
+			return
+		}
+		if req.Method == "GET" && len(info.Op) == 0 && StreamReadOperation(rw, req, info) {
+			info.Close()
+			return
+		}
+		response = RunWithDeadline(req, IsWrite(req, info), func() R {
+			// The handler may outlive the request, if it times out; the
+			// connection goes back to the pool only once it's finished.
+			//
+			defer info.Close()
+			return HandleRequest(req, info)
+		})
+	} else {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+	}
+	WriteResponse(rw, req, response)
+	return
+}
+
+// Runs the checks every request goes through before it reaches Redis: the
+// upstream's ACL, the tenant, read-only mode and rate limits, in that order.
+//
+func CheckRequest(rw http.ResponseWriter, req *http.Request, info *RequestInfo) (response R, denied bool) {
+	if response, denied = CheckACL(req, info.Upstream, IsWrite(req, info)); denied {
+		return
+	}
+	if response, denied = CheckTenant(info); denied {
+		return
+	}
+	if response, denied = CheckReadOnly(req, info); denied {
+		return
+	}
+	response, denied = CheckRateLimit(rw, req, info)
+	return
+}
 
-		case "POST":
-			response = HandleCreateOperation(req, info)
+// Calls the handler for the operation the request names, or otherwise the
+// action handler for the HTTP method that was used.
+//
+func HandleRequest(req *http.Request, info *RequestInfo) (response R) {
+	if len(info.Op) > 0 {
+		response = HandleOperation(req, info)
+		return
+	}
 
-		case "PUT":
-			response = HandleUpdateOperation(req, info)
+	switch req.Method {
+	case "GET":
+		response = HandleReadOperation(req, info)
 
-		case "DELETE":
-			response = HandleDeleteOperation(req, info)
-		}
-	} else {
-		response = R{"result": nil, "error": err}
+	case "POST":
+		response = HandleCreateOperation(req, info)
+
+	case "PUT":
+		response = HandleUpdateOperation(req, info)
+
+	case "DELETE":
+		response = HandleDeleteOperation(req, info)
+
+	case "PATCH":
+		response = HandlePatchOperation(req, info)
+
+	default:
+		e := "Method not allowed."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusMethodNotAllowed)
 	}
-	rw.Header().Set("Content-Type", "application/json")
-	fmt.Fprint(rw, response)
 	return
 }
 
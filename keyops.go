@@ -0,0 +1,258 @@
+// keyops.go
+//
+// Key management: renaming keys, copying them, and moving them to another
+// database.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Operations["rename"] = Operation{Methods: []string{"POST"}, Handler: HandleRename}
+	Operations["copy"] = Operation{Methods: []string{"POST"}, Handler: HandleCopy}
+	Operations["move"] = Operation{Methods: []string{"POST"}, Handler: HandleMove}
+	return
+}
+
+// The target of a rename, copy or move: the request's key and database,
+// unless the "to" and "db" parameters say otherwise.
+//
+func keyTarget(req *http.Request, info *RequestInfo) (target *RequestInfo, overwrite bool, response R) {
+	t := *info
+	t.conn = nil
+	target = &t
+	if to := req.FormValue("to"); len(to) > 0 {
+		target.Key = to
+	}
+	if db := req.FormValue("db"); len(db) > 0 {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			e := fmt.Sprintf("Invalid database number: %s", db)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		target.DbNum = n
+	}
+	if target.DbNum != info.DbNum && ReadOnly.Is(target.DatabaseName()) {
+		e := fmt.Sprintf("Database %s is read-only.", target.DatabaseName())
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusForbidden)
+		return
+	}
+	overwrite = req.FormValue("overwrite") == "true"
+	return
+}
+
+// Returns a 404 response if the key doesn't exist.
+//
+func keyMissing(client redis.Conn, key string) (response R, missing bool) {
+	exists, err := redis.Bool(client.Do("EXISTS", key))
+	if err != nil {
+		response = ErrorResponse(err)
+		missing = true
+		return
+	}
+	if !exists {
+		response = R{"result": nil, "error": "Key does not exist."}.WithStatus(http.StatusNotFound)
+		missing = true
+	}
+	return
+}
+
+func targetExists(target *RequestInfo) (response R) {
+	e := fmt.Sprintf("Key %s already exists in database %s.", target.Key, target.DatabaseName())
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+	return
+}
+
+// Handles POST /{db}/{key}/rename?to={newkey}. An existing key by the new
+// name is only replaced when "overwrite=true" is given; otherwise the
+// response is a 409.
+//
+func HandleRename(req *http.Request, info *RequestInfo) (response R) {
+	target, overwrite, response := keyTarget(req, info)
+	if response != nil {
+		return
+	}
+	if target.DbNum != info.DbNum {
+		e := "Keys can only be renamed within a database; use move."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	if target.Key == info.Key {
+		e := "Missing required parameter: to."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	if response, missing := keyMissing(client, info.Key); missing {
+		return response
+	}
+
+	if overwrite {
+		println("RENAME", info.Key, target.Key)
+		_, err = client.Do("RENAME", info.Key, target.Key)
+	} else {
+		println("RENAMENX", info.Key, target.Key)
+		var renamed bool
+		renamed, err = redis.Bool(client.Do("RENAMENX", info.Key, target.Key))
+		if err == nil && !renamed {
+			response = targetExists(target)
+			return
+		}
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": true, "error": nil}
+	return
+}
+
+// Handles POST /{db}/{key}/copy?to={newkey}&db={n}. Either parameter may be
+// left out, but not both. Responds with a 201, or a 409 if the target exists
+// and "overwrite=true" wasn't given.
+//
+func HandleCopy(req *http.Request, info *RequestInfo) (response R) {
+	target, overwrite, response := keyTarget(req, info)
+	if response != nil {
+		return
+	}
+	if target.Key == info.Key && target.DbNum == info.DbNum {
+		e := "Give a new name (to) or database (db) to copy the key to."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	if response, missing := keyMissing(client, info.Key); missing {
+		return response
+	}
+
+	copied, err := copyKey(client, info, target, overwrite)
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	if !copied {
+		response = targetExists(target)
+		return
+	}
+	response = R{"result": true, "error": nil}.WithStatus(http.StatusCreated)
+	return
+}
+
+// Handles POST /{db}/{key}/move?db={n}. MOVE never replaces a key; with
+// "overwrite=true", the key is copied over the target instead, and then
+// deleted, which is not atomic.
+//
+func HandleMove(req *http.Request, info *RequestInfo) (response R) {
+	target, overwrite, response := keyTarget(req, info)
+	if response != nil {
+		return
+	}
+	if len(req.FormValue("db")) == 0 || target.DbNum == info.DbNum {
+		e := "Give a different database (db) to move the key to."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	if target.Key != info.Key {
+		e := "Keys keep their name when moved; use copy."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	if response, missing := keyMissing(client, info.Key); missing {
+		return response
+	}
+
+	if overwrite {
+		if _, err = copyKey(client, info, target, true); err == nil {
+			println("DEL", info.Key)
+			_, err = client.Do("DEL", info.Key)
+		}
+	} else {
+		println("MOVE", info.Key, target.DbNum)
+		var moved bool
+		moved, err = redis.Bool(client.Do("MOVE", info.Key, target.DbNum))
+		if err == nil && !moved {
+			response = targetExists(target)
+			return
+		}
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": true, "error": nil}
+	return
+}
+
+// Copies a key with COPY, or, on servers older than Redis 6.2, with DUMP and
+// RESTORE (keeping its TTL). Returns false if the target exists and may not
+// be replaced.
+//
+func copyKey(client redis.Conn, src, dst *RequestInfo, replace bool) (copied bool, err error) {
+	args := redis.Args{}.Add(src.Key, dst.Key)
+	if dst.DbNum != src.DbNum {
+		args = args.Add("DB", dst.DbNum)
+	}
+	if replace {
+		args = args.Add("REPLACE")
+	}
+	println("COPY", src.Key, dst.Key, dst.DbNum)
+	copied, err = redis.Bool(client.Do("COPY", args...))
+	if !unknownCommand(err) {
+		return
+	}
+
+	println("DUMP", src.Key)
+	payload, err := redis.Bytes(client.Do("DUMP", src.Key))
+	if err != nil {
+		return
+	}
+	ttl, err := redis.Int64(client.Do("PTTL", src.Key))
+	if err != nil {
+		return
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+
+	target, err := dst.DB()
+	if err != nil {
+		return
+	}
+	defer dst.Close()
+	args = redis.Args{}.Add(dst.Key, ttl, payload)
+	if replace {
+		args = args.Add("REPLACE")
+	}
+	println("RESTORE", dst.Key, dst.DbNum)
+	_, err = target.Do("RESTORE", args...)
+	if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYKEY") {
+		err = nil
+		return
+	}
+	copied = err == nil
+	return
+}
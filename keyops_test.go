@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// A connection to one database of a pretend server that predates COPY, so
+// copies fall back to DUMP and RESTORE.
+//
+type fakeDB struct {
+	keys     map[string]string
+	restored []string
+}
+
+func (c *fakeDB) Close() error                               { return nil }
+func (c *fakeDB) Err() error                                 { return nil }
+func (c *fakeDB) Send(cmd string, args ...interface{}) error { return nil }
+func (c *fakeDB) Flush() error                               { return nil }
+func (c *fakeDB) Receive() (interface{}, error)              { return nil, nil }
+
+func (c *fakeDB) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	key, _ := args[0].(string)
+	switch strings.ToUpper(cmd) {
+	case "EXISTS":
+		_, ok := c.keys[key]
+		reply = int64(0)
+		if ok {
+			reply = int64(1)
+		}
+	case "COPY":
+		err = redis.Error("ERR unknown command 'COPY'")
+	case "DUMP":
+		reply = []byte(c.keys[key])
+	case "PTTL":
+		reply = int64(-1)
+	case "RESTORE":
+		if _, ok := c.keys[key]; ok {
+			err = redis.Error("BUSYKEY Target key name already exists.")
+			return
+		}
+		c.keys[key] = string(args[2].([]byte))
+		c.restored = append(c.restored, key)
+		reply = "OK"
+	}
+	return
+}
+
+func TestCopyAcrossDatabases(t *testing.T) {
+	defer func(c *Configuration, d *ConnectionMap) { config, Database = c, d }(config, Database)
+	config = &Configuration{}
+
+	dbs := map[int]*fakeDB{
+		0: {keys: map[string]string{"k": "payload"}},
+		2: {keys: map[string]string{}},
+	}
+	Database = &ConnectionMap{pools: make(map[int]*redis.Pool)}
+	for n, db := range dbs {
+		db := db
+		Database.pools[n] = &redis.Pool{Dial: func() (redis.Conn, error) { return db, nil }}
+	}
+
+	req, _ := http.NewRequest("POST", "/0/k/copy?db=2", nil)
+	info := &RequestInfo{DbNum: 0, Key: "k", ctx: context.Background()}
+	defer info.Close()
+	// Anything before the handler may already have taken the request's
+	// connection.
+	//
+	if _, err := info.DB(); err != nil {
+		t.Fatal(err)
+	}
+	response := HandleCopy(req, info)
+	if response["error"] != nil {
+		t.Fatalf("HandleCopy failed: %v", response["error"])
+	}
+	if len(dbs[2].restored) != 1 || dbs[2].keys["k"] != "payload" {
+		t.Errorf("The key was not restored into database 2: %v", dbs[2].keys)
+	}
+	if len(dbs[0].restored) != 0 {
+		t.Errorf("The key was restored into database 0: %v", dbs[0].restored)
+	}
+	if n := Database.pools[2].ActiveCount(); n != 0 {
+		t.Errorf("%d connections to database 2 were not released", n)
+	}
+}
@@ -0,0 +1,356 @@
+// lock.go
+//
+// Distributed locks, under /_locks/{name}, for clients that only speak HTTP.
+// A lock is a key set with SET NX PX to a random token, which is handed to
+// whoever acquired it; extending or releasing the lock takes that token, so
+// a client can't release a lock that has expired and been taken by someone
+// else.
+//
+// Each lock has its keys under the hash tag {name}:
+//
+//	scarlet:lock:{name}        the lock itself, holding the token
+//	scarlet:lock:{name}:info   hash of who holds it, since when, and its
+//	                           fencing token; expires with the lock
+//	scarlet:lock:{name}:fence  fencing token counter, which never expires
+//
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultLockTTL = 30 * time.Second
+	MaxLockTTL     = 24 * time.Hour
+
+	// Clients may send the lock token in this header, instead of in the
+	// "token" parameter.
+	//
+	LockTokenHeader = "X-Scarlet-Lock-Token"
+)
+
+func lockKey(name string) string {
+	return "scarlet:lock:{" + name + "}"
+}
+
+// The time the lock was acquired is passed in, rather than read with TIME:
+// servers before Redis 5 refuse writes from a script once it has called it.
+//
+// KEYS: lock, info, fence
+// ARGV: token, ttl (ms), holder, fencing ("1" to hand out a fencing token),
+// now (Unix seconds)
+//
+var acquireLockScript = redis.NewScript(3, `
+if not redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+  return false
+end
+local fence = 0
+if ARGV[4] == '1' then
+  fence = redis.call('INCR', KEYS[3])
+end
+redis.call('DEL', KEYS[2])
+redis.call('HSET', KEYS[2], 'holder', ARGV[3], 'acquired', ARGV[5], 'fence', fence)
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return fence
+`)
+
+// Both return -1 if the lock isn't held, 0 if it is held with another token,
+// and 1 if it was extended (or released).
+//
+// KEYS: lock, info
+// ARGV: token, ttl (ms)
+//
+var extendLockScript = redis.NewScript(2, `
+local token = redis.call('GET', KEYS[1])
+if not token then
+  return -1
+elseif token ~= ARGV[1] then
+  return 0
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[2])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// KEYS: lock, info
+// ARGV: token
+//
+var releaseLockScript = redis.NewScript(2, `
+local token = redis.call('GET', KEYS[1])
+if not token then
+  return -1
+elseif token ~= ARGV[1] then
+  return 0
+end
+redis.call('DEL', KEYS[1], KEYS[2])
+return 1
+`)
+
+// Handles every request under /_locks/:
+//
+//	POST   /_locks/{name}  acquire the lock for "ttl" (or the default), as
+//	                       "holder"; with "fencing=true", a fencing token is
+//	                       handed out too
+//	PUT    /_locks/{name}  extend the lock to "ttl" from now
+//	DELETE /_locks/{name}  release the lock
+//	GET    /_locks/{name}  who holds the lock, and for how much longer
+//	GET    /_locks/        every lock that is currently held
+//
+// PUT and DELETE need the token handed out by POST, as the "token" parameter
+// or the X-Scarlet-Lock-Token header. Locks are kept in the database set by
+// locks.database on the default upstream.
+//
+func LockHandler(rw http.ResponseWriter, req *http.Request) {
+	if !config.Locks.Enabled {
+		http.NotFound(rw, req)
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, "/_locks/")
+	if len(name) > 0 && !ResourceNameRegex.MatchString(name) {
+		e := fmt.Sprintf("Invalid lock name: %q", name)
+		WriteResponse(rw, req, R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest))
+		return
+	}
+
+	info := &RequestInfo{DbNum: config.Locks.Database, Tenant: TenantFor(req), ctx: req.Context()}
+	defer info.Close()
+	if response, denied := CheckRequest(rw, req, info); denied {
+		WriteResponse(rw, req, response)
+		return
+	}
+
+	var response R
+	switch {
+	case req.Method == "GET" && len(name) == 0:
+		response = ListLocks(info)
+	case req.Method == "GET":
+		response = GetLock(info, name)
+	case len(name) == 0:
+		e := "A lock name is required."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	case req.Method == "POST":
+		response = AcquireLock(req, info, name)
+	case req.Method == "PUT" || req.Method == "DELETE":
+		response = UpdateLock(req, info, name)
+	default:
+		e := fmt.Sprintf("Method %s is not allowed.", req.Method)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusMethodNotAllowed)
+	}
+	WriteResponse(rw, req, response)
+	return
+}
+
+// Returns the lock's time to live, from the "ttl" parameter.
+//
+func lockTTL(req *http.Request) (ttl time.Duration, response R) {
+	def, _ := parseDuration(config.Locks.DefaultTTL, DefaultLockTTL)
+	max, _ := parseDuration(config.Locks.MaxTTL, MaxLockTTL)
+	if ttl, response = durationParam(req, "ttl", def); response != nil {
+		return
+	}
+	if ttl < time.Millisecond || ttl > max {
+		e := fmt.Sprintf("The \"ttl\" parameter must be between 1ms and %s.", max)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+// Returns 32 random hex digits, for tokens and ids nobody can guess.
+//
+func randomToken() (token string, err error) {
+	b := make([]byte, 16)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	token = hex.EncodeToString(b)
+	return
+}
+
+// Acquires a lock, responding with a 201 and the lock's token, or a 409 (and
+// who holds the lock) if it is already held.
+//
+func AcquireLock(req *http.Request, info *RequestInfo, name string) (response R) {
+	ttl, response := lockTTL(req)
+	if response != nil {
+		return
+	}
+	holder := req.FormValue("holder")
+	if len(holder) == 0 {
+		holder = req.RemoteAddr
+	}
+	fencing := "0"
+	if req.FormValue("fencing") == "true" {
+		fencing = "1"
+	}
+	token, err := randomToken()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	key := lockKey(name)
+	args := []interface{}{key, key + ":info", key + ":fence", token, int64(ttl / time.Millisecond), holder, fencing, time.Now().Unix()}
+	fence, err := redis.Int64(acquireLockScript.Do(client, args...))
+	if err == redis.ErrNil {
+		state, _ := lockState(client, name)
+		e := fmt.Sprintf("Lock %s is already held.", name)
+		response = R{"result": state, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	println("LOCK", name, holder)
+	result := R{"token": token, "expires": time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)}
+	if fencing == "1" {
+		result["fence"] = fence
+	}
+	response = R{"result": result, "error": nil}.WithStatus(http.StatusCreated)
+	return
+}
+
+// Extends (PUT) or releases (DELETE) a lock. Responds with a 404 if the lock
+// isn't held, and a 409 if it is held with another token.
+//
+func UpdateLock(req *http.Request, info *RequestInfo, name string) (response R) {
+	token := req.FormValue("token")
+	if len(token) == 0 {
+		token = req.Header.Get(LockTokenHeader)
+	}
+	if len(token) == 0 {
+		e := "The lock's token is required."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	key := lockKey(name)
+	var n int
+	if req.Method == "PUT" {
+		var ttl time.Duration
+		if ttl, response = lockTTL(req); response != nil {
+			return
+		}
+		println("LOCK", "extend", name)
+		n, err = redis.Int(extendLockScript.Do(client, key, key+":info", token, int64(ttl/time.Millisecond)))
+	} else {
+		println("LOCK", "release", name)
+		n, err = redis.Int(releaseLockScript.Do(client, key, key+":info", token))
+	}
+	switch {
+	case err != nil:
+		response = ErrorResponse(err)
+	case n < 0:
+		e := fmt.Sprintf("Lock %s is not held.", name)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+	case n == 0:
+		e := fmt.Sprintf("Lock %s is held with another token.", name)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+	default:
+		response = R{"result": true, "error": nil}
+	}
+	return
+}
+
+// Returns whether a lock is held, and if it is, by whom, since when, until
+// when, and with which fencing token (if one was handed out). The token
+// itself is never shown.
+//
+func lockState(client redis.Conn, name string) (state R, err error) {
+	key := lockKey(name)
+	ttl, err := redis.Int64(client.Do("PTTL", key))
+	if err != nil {
+		return
+	}
+	state = R{"name": name, "locked": ttl != -2}
+	if ttl == -2 {
+		return
+	}
+	if ttl >= 0 {
+		state["expires"] = time.Now().Add(time.Duration(ttl) * time.Millisecond).UTC().Format(time.RFC3339Nano)
+	}
+	fields, err := redis.StringMap(client.Do("HGETALL", key+":info"))
+	if err != nil {
+		return
+	}
+	state["holder"] = fields["holder"]
+	if secs, e := strconv.ParseInt(fields["acquired"], 10, 64); e == nil {
+		state["acquired"] = time.Unix(secs, 0).UTC().Format(time.RFC3339)
+	}
+	if fence, e := strconv.ParseInt(fields["fence"], 10, 64); e == nil && fence > 0 {
+		state["fence"] = fence
+	}
+	return
+}
+
+func GetLock(info *RequestInfo, name string) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	state, err := lockState(client, name)
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": state, "error": nil}
+	return
+}
+
+// Returns the state of every lock that is currently held.
+//
+func ListLocks(info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	locks := []R{}
+	cursor := "0"
+	for {
+		var reply []interface{}
+		if reply, err = redis.Values(client.Do("SCAN", cursor, "MATCH", "scarlet:lock:{*}", "COUNT", 100)); err == nil && len(reply) != 2 {
+			err = fmt.Errorf("Unexpected reply to SCAN")
+		}
+		var keys []string
+		if err == nil {
+			cursor, err = redis.String(reply[0], nil)
+		}
+		if err == nil {
+			keys, err = redis.Strings(reply[1], nil)
+		}
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		for _, key := range keys {
+			name := strings.TrimSuffix(strings.TrimPrefix(key, "scarlet:lock:{"), "}")
+			if state, e := lockState(client, name); e == nil && state["locked"] == true {
+				locks = append(locks, state)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	response = R{"result": locks, "error": nil}
+	return
+}
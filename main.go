@@ -24,6 +24,7 @@ var (
 	debug         = flag.Bool("d", false, "Enable debugging")
 	RedisAddress  = flag.String("r", DefaultRedisAddress, "The upstream Redis host to connect to")
 	RedisPassword = flag.String("rp", "", "Password to use when authenticating to the upstream Redis host")
+	rebalance     = flag.Bool("rebalance", false, "Move keys to the shard that owns them, then exit")
 	config        *Configuration
 	Database      *ConnectionMap
 	systemSignals = make(chan os.Signal)
@@ -41,27 +42,71 @@ func main() {
 	if *debug {
 		println("debug:", "using configuration file", *configPath)
 	}
-	config, err := LoadConfig(*configPath)
+	var err error
+	config, err = LoadConfig(*configPath)
 	if err != nil {
 		panic(err)
 	}
+	if err = config.Validate(); err != nil {
+		panic(err)
+	}
+	if err = LoadSchemas(config.Schemas); err != nil {
+		panic(err)
+	}
 	if config.Redis.InfoDisabled() {
 		println("Retrieving node information is disabled")
 	}
+	if len(config.Tenants) > 0 && !config.TenantRequired() {
+		println("WARNING: requireTenant is off; requests that don't belong to a tenant can see every tenant's keys")
+	}
 
 	// Connect to the initial Redis host
 	//
 	if *RedisAddress != DefaultRedisAddress {
-		Database = NewConnectionMap(*RedisAddress, *RedisPassword)
+		Database = NewConnectionMap(*RedisAddress, *RedisPassword, config.Redis.Timeouts())
+		err = Database.PopulateConnections()
 	} else {
-		Database = NewConnectionMap(config.Redis.ConnectAddr(), config.Redis.Password)
+		Database, err = NewUpstream(config.Redis)
 	}
-	err = Database.PopulateConnections()
 	if err != nil {
 		fmt.Printf("FATAL\tCould not populate connections: %s\n", err)
 		return
 	}
 
+	if err = ConnectUpstreams(config.Upstreams); err != nil {
+		fmt.Printf("FATAL\t%s\n", err)
+		return
+	}
+
+	// When asked to rebalance the shards, do that, and nothing else.
+	//
+	if *rebalance {
+		if Database.shards == nil {
+			fmt.Println("FATAL\tThere are no shards to rebalance")
+			return
+		}
+		moved, stale, err := Database.shards.Rebalance()
+		fmt.Printf("Moved %d keys, dropped %d stale copies\n", moved, stale)
+		if err != nil {
+			fmt.Printf("FATAL\tCould not rebalance shards: %s\n", err)
+		}
+		return
+	}
+
+	RateLimiter = NewLimiter(config.RateLimit, Database)
+
+	if err = StartWebhooks(config.Webhooks); err != nil {
+		fmt.Printf("FATAL\t%s\n", err)
+		return
+	}
+
+	if config.Queues.Enabled {
+		go ReapQueues(Database)
+	}
+	if config.Schedule.Enabled {
+		go RunScheduler(Database)
+	}
+
 	// If the HTTP server was enabled in the configuration, start it.
 	//
 	if config.HTTP.Enabled {
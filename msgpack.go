@@ -0,0 +1,221 @@
+// msgpack.go
+//
+// A small MessagePack encoder, covering the types Scarlet puts into its
+// responses.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// Encodes v as MessagePack. Strings are written as "str", byte slices as
+// "bin", and anything that is not a basic type, slice or map is run through
+// encoding/json first, so it looks the same as it would in a JSON response.
+//
+func MarshalMsgpack(v interface{}) (b []byte, err error) {
+	var buf bytes.Buffer
+	if err = encodeMsgpack(&buf, reflect.ValueOf(v)); err != nil {
+		return
+	}
+	b = buf.Bytes()
+	return
+}
+
+func encodeMsgpack(buf *bytes.Buffer, v reflect.Value) (err error) {
+	if !v.IsValid() {
+		buf.WriteByte(0xc0)
+		return
+	}
+
+	if v.Type().Implements(errorType) && v.Kind() != reflect.Interface {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			buf.WriteByte(0xc0)
+			return
+		}
+		writeMsgpackString(buf, v.Interface().(error).Error())
+		return
+	}
+
+	switch v.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return
+		}
+		err = encodeMsgpack(buf, v.Elem())
+
+	case reflect.Bool:
+		if v.Bool() {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		writeMsgpackInt(buf, v.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		writeMsgpackUint(buf, v.Uint())
+
+	case reflect.Float32:
+		buf.WriteByte(0xca)
+		binary.Write(buf, binary.BigEndian, math.Float32bits(float32(v.Float())))
+
+	case reflect.Float64:
+		buf.WriteByte(0xcb)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v.Float()))
+
+	case reflect.String:
+		writeMsgpackString(buf, v.String())
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			buf.WriteByte(0xc0)
+			return
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			writeMsgpackBinary(buf, v.Bytes())
+			return
+		}
+		writeMsgpackHeader(buf, v.Len(), 0x90, 0xdc, 0xdd)
+		for i := 0; i < v.Len(); i++ {
+			if err = encodeMsgpack(buf, v.Index(i)); err != nil {
+				return
+			}
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			buf.WriteByte(0xc0)
+			return
+		}
+		keys := v.MapKeys()
+		if v.Type().Key().Kind() == reflect.String {
+			sort.Slice(keys, func(i, j int) bool {
+				return keys[i].String() < keys[j].String()
+			})
+		}
+		writeMsgpackHeader(buf, len(keys), 0x80, 0xde, 0xdf)
+		for _, k := range keys {
+			if err = encodeMsgpack(buf, k); err != nil {
+				return
+			}
+			if err = encodeMsgpack(buf, v.MapIndex(k)); err != nil {
+				return
+			}
+		}
+
+	default:
+		// Structs, and anything else: let encoding/json decide what they
+		// look like, then encode that.
+		//
+		var b []byte
+		if b, err = json.Marshal(v.Interface()); err != nil {
+			return
+		}
+		var generic interface{}
+		if err = json.Unmarshal(b, &generic); err != nil {
+			return
+		}
+		err = encodeMsgpack(buf, reflect.ValueOf(generic))
+	}
+	return
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0:
+		writeMsgpackUint(buf, uint64(i))
+	case i >= -32:
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func writeMsgpackUint(buf *bytes.Buffer, u uint64) {
+	switch {
+	case u <= 0x7f:
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(u))
+	case u <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(u))
+	case u <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(u))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, u)
+	}
+}
+
+func writeMsgpackString(buf *bytes.Buffer, s string) {
+	n := len(s)
+	switch {
+	case n < 32:
+		buf.WriteByte(0xa0 | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xd9)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xda)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xdb)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.WriteString(s)
+}
+
+func writeMsgpackBinary(buf *bytes.Buffer, b []byte) {
+	n := len(b)
+	switch {
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xc4)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xc5)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(0xc6)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+	buf.Write(b)
+}
+
+// Writes the header for an array or a map holding n items; fix is the
+// "fixarray"/"fixmap" prefix, which is used for fewer than 16 items.
+//
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix, b16, b32 byte) {
+	switch {
+	case n < 16:
+		buf.WriteByte(fix | byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(b16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(b32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
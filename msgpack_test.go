@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A decoder for what the encoder writes, following the byte layouts in the
+// MessagePack spec, so the tests can check values survive the round trip.
+//
+func decodeMsgpack(b []byte) (v interface{}, rest []byte, err error) {
+	if len(b) == 0 {
+		err = fmt.Errorf("unexpected end of input")
+		return
+	}
+	c, b := b[0], b[1:]
+	take := func(n int) (p []byte) {
+		if len(b) < n {
+			err = fmt.Errorf("want %d bytes, have %d", n, len(b))
+			return
+		}
+		p, b = b[:n], b[n:]
+		return
+	}
+	length := func(size int) (n int) {
+		p := take(size)
+		switch size {
+		case 1:
+			n = int(p[0])
+		case 2:
+			n = int(binary.BigEndian.Uint16(p))
+		case 4:
+			n = int(binary.BigEndian.Uint32(p))
+		}
+		return
+	}
+	elements := func(n int) (a []interface{}) {
+		a = []interface{}{}
+		for i := 0; i < n && err == nil; i++ {
+			var e interface{}
+			e, b, err = decodeMsgpack(b)
+			a = append(a, e)
+		}
+		return
+	}
+	entries := func(n int) (m map[string]interface{}) {
+		m = make(map[string]interface{})
+		for i := 0; i < n && err == nil; i++ {
+			var k, e interface{}
+			if k, b, err = decodeMsgpack(b); err != nil {
+				return
+			}
+			e, b, err = decodeMsgpack(b)
+			m[fmt.Sprint(k)] = e
+		}
+		return
+	}
+
+	switch {
+	case c <= 0x7f:
+		v = int64(c)
+	case c >= 0xe0:
+		v = int64(int8(c))
+	case c&0xe0 == 0xa0:
+		v = string(take(int(c & 0x1f)))
+	case c&0xf0 == 0x90:
+		v = elements(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		v = entries(int(c & 0x0f))
+	case c == 0xc0:
+	case c == 0xc2, c == 0xc3:
+		v = c == 0xc3
+	case c == 0xc4:
+		v = append([]byte{}, take(length(1))...)
+	case c == 0xc5:
+		v = append([]byte{}, take(length(2))...)
+	case c == 0xc6:
+		v = append([]byte{}, take(length(4))...)
+	case c == 0xca:
+		v = float64(math.Float32frombits(binary.BigEndian.Uint32(take(4))))
+	case c == 0xcb:
+		v = math.Float64frombits(binary.BigEndian.Uint64(take(8)))
+	case c == 0xcc:
+		v = int64(take(1)[0])
+	case c == 0xcd:
+		v = int64(binary.BigEndian.Uint16(take(2)))
+	case c == 0xce:
+		v = int64(binary.BigEndian.Uint32(take(4)))
+	case c == 0xcf:
+		v = binary.BigEndian.Uint64(take(8))
+	case c == 0xd0:
+		v = int64(int8(take(1)[0]))
+	case c == 0xd1:
+		v = int64(int16(binary.BigEndian.Uint16(take(2))))
+	case c == 0xd2:
+		v = int64(int32(binary.BigEndian.Uint32(take(4))))
+	case c == 0xd3:
+		v = int64(binary.BigEndian.Uint64(take(8)))
+	case c == 0xd9:
+		v = string(take(length(1)))
+	case c == 0xda:
+		v = string(take(length(2)))
+	case c == 0xdb:
+		v = string(take(length(4)))
+	case c == 0xdc:
+		v = elements(length(2))
+	case c == 0xdd:
+		v = elements(length(4))
+	case c == 0xde:
+		v = entries(length(2))
+	case c == 0xdf:
+		v = entries(length(4))
+	default:
+		err = fmt.Errorf("unknown type byte 0x%02x", c)
+	}
+	rest = b
+	return
+}
+
+func roundTrip(t *testing.T, in interface{}) (out interface{}, encoded []byte) {
+	encoded, err := MarshalMsgpack(in)
+	if err != nil {
+		t.Fatalf("MarshalMsgpack(%v): %s", in, err)
+	}
+	out, rest, err := decodeMsgpack(encoded)
+	if err != nil || len(rest) > 0 {
+		t.Fatalf("decoding %x: %v (%d bytes left)", encoded, err, len(rest))
+	}
+	return
+}
+
+func TestMsgpackIntegers(t *testing.T) {
+	tests := []struct {
+		in     int64
+		header []byte
+		size   int
+	}{
+		{0, []byte{0x00}, 1},
+		{127, []byte{0x7f}, 1},
+		{128, []byte{0xcc, 0x80}, 2},
+		{255, []byte{0xcc, 0xff}, 2},
+		{256, []byte{0xcd, 0x01, 0x00}, 3},
+		{65535, []byte{0xcd, 0xff, 0xff}, 3},
+		{65536, []byte{0xce, 0x00, 0x01}, 5},
+		{math.MaxUint32, []byte{0xce, 0xff}, 5},
+		{math.MaxUint32 + 1, []byte{0xcf, 0x00, 0x00, 0x00, 0x01}, 9},
+		{math.MaxInt64, []byte{0xcf, 0x7f}, 9},
+		{-1, []byte{0xff}, 1},
+		{-32, []byte{0xe0}, 1},
+		{-33, []byte{0xd0, 0xdf}, 2},
+		{math.MinInt8, []byte{0xd0, 0x80}, 2},
+		{math.MinInt8 - 1, []byte{0xd1, 0xff, 0x7f}, 3},
+		{math.MinInt16, []byte{0xd1, 0x80, 0x00}, 3},
+		{math.MinInt16 - 1, []byte{0xd2, 0xff, 0xff, 0x7f}, 5},
+		{math.MinInt32, []byte{0xd2, 0x80}, 5},
+		{math.MinInt32 - 1, []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0x7f}, 9},
+		{math.MinInt64, []byte{0xd3, 0x80}, 9},
+	}
+	for _, test := range tests {
+		out, encoded := roundTrip(t, test.in)
+		if !bytes.HasPrefix(encoded, test.header) || len(encoded) != test.size {
+			t.Errorf("%d: encoded as %x, want %x... (%d bytes)", test.in, encoded, test.header, test.size)
+		}
+		if u, ok := out.(uint64); ok {
+			out = int64(u)
+		}
+		if out != test.in {
+			t.Errorf("%d: decoded as %v", test.in, out)
+		}
+	}
+
+	if _, encoded := roundTrip(t, uint64(math.MaxUint64)); !bytes.Equal(encoded, []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}) {
+		t.Errorf("MaxUint64: encoded as %x", encoded)
+	}
+}
+
+func TestMsgpackStrings(t *testing.T) {
+	tests := []struct {
+		n      int
+		header []byte
+	}{
+		{0, []byte{0xa0}},
+		{31, []byte{0xbf}},
+		{32, []byte{0xd9, 32}},
+		{255, []byte{0xd9, 0xff}},
+		{256, []byte{0xda, 0x01, 0x00}},
+		{65535, []byte{0xda, 0xff, 0xff}},
+		{65536, []byte{0xdb, 0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		s := strings.Repeat("x", test.n)
+		out, encoded := roundTrip(t, s)
+		if !bytes.HasPrefix(encoded, test.header) || len(encoded) != len(test.header)+test.n {
+			t.Errorf("str of %d: header %x, want %x", test.n, encoded[:len(test.header)], test.header)
+		}
+		if out != s {
+			t.Errorf("str of %d: did not survive the round trip", test.n)
+		}
+	}
+}
+
+func TestMsgpackBinary(t *testing.T) {
+	tests := []struct {
+		n      int
+		header []byte
+	}{
+		{0, []byte{0xc4, 0x00}},
+		{255, []byte{0xc4, 0xff}},
+		{256, []byte{0xc5, 0x01, 0x00}},
+		{65535, []byte{0xc5, 0xff, 0xff}},
+		{65536, []byte{0xc6, 0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		b := bytes.Repeat([]byte{0xfe}, test.n)
+		out, encoded := roundTrip(t, b)
+		if !bytes.HasPrefix(encoded, test.header) || len(encoded) != len(test.header)+test.n {
+			t.Errorf("bin of %d: header %x, want %x", test.n, encoded[:len(test.header)], test.header)
+		}
+		if !bytes.Equal(out.([]byte), b) {
+			t.Errorf("bin of %d: did not survive the round trip", test.n)
+		}
+	}
+}
+
+func TestMsgpackArraysAndMaps(t *testing.T) {
+	tests := []struct {
+		n      int
+		array  []byte
+		mapHdr []byte
+	}{
+		{0, []byte{0x90}, []byte{0x80}},
+		{15, []byte{0x9f}, []byte{0x8f}},
+		{16, []byte{0xdc, 0x00, 0x10}, []byte{0xde, 0x00, 0x10}},
+		{65535, []byte{0xdc, 0xff, 0xff}, []byte{0xde, 0xff, 0xff}},
+		{65536, []byte{0xdd, 0x00, 0x01, 0x00, 0x00}, []byte{0xdf, 0x00, 0x01, 0x00, 0x00}},
+	}
+	for _, test := range tests {
+		a := make([]string, test.n)
+		m := make(map[string]int, test.n)
+		for i := range a {
+			a[i] = "v"
+			m[fmt.Sprint(i)] = i
+		}
+
+		out, encoded := roundTrip(t, a)
+		if !bytes.HasPrefix(encoded, test.array) || len(out.([]interface{})) != test.n {
+			t.Errorf("array of %d: header %x, want %x", test.n, encoded[:len(test.array)], test.array)
+		}
+
+		out, encoded = roundTrip(t, m)
+		decoded := out.(map[string]interface{})
+		if !bytes.HasPrefix(encoded, test.mapHdr) || len(decoded) != test.n {
+			t.Errorf("map of %d: header %x, want %x", test.n, encoded[:len(test.mapHdr)], test.mapHdr)
+		}
+		for k, v := range m {
+			if decoded[k] != int64(v) {
+				t.Fatalf("map of %d: %s is %v, want %d", test.n, k, decoded[k], v)
+			}
+		}
+	}
+}
+
+func TestMsgpackValues(t *testing.T) {
+	var nilMap map[string]string
+	var nilErr error
+	tests := []struct {
+		in  interface{}
+		out interface{}
+	}{
+		{nil, nil},
+		{true, true},
+		{false, false},
+		{nilMap, nil},
+		{nilErr, nil},
+		{1.5, 1.5},
+		{float32(0.25), 0.25},
+		{fmt.Errorf("boom"), "boom"},
+		{R{"result": "v", "error": nil}, map[string]interface{}{"result": "v", "error": nil}},
+		{struct {
+			A int `json:"a"`
+		}{7}, map[string]interface{}{"a": 7.0}},
+	}
+	for _, test := range tests {
+		out, encoded := roundTrip(t, test.in)
+		if !reflect.DeepEqual(out, test.out) {
+			t.Errorf("%#v: encoded as %x, decoded as %#v, want %#v", test.in, encoded, out, test.out)
+		}
+	}
+
+	// Map keys are written in order, so responses are stable.
+	//
+	_, encoded := roundTrip(t, map[string]int{"b": 2, "a": 1})
+	if !bytes.Equal(encoded, []byte{0x82, 0xa1, 'a', 0x01, 0xa1, 'b', 0x02}) {
+		t.Errorf("map encoded as %x", encoded)
+	}
+}
@@ -0,0 +1,94 @@
+// ops.go
+//
+// Operations are actions on a key other than plain reads and writes, named
+// by the last segment of the URL, e.g. POST /0/visits/incr. Each file that
+// provides operations registers them in its init function.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strings"
+)
+
+type Operation struct {
+	// The HTTP methods the operation answers to.
+	//
+	Methods []string
+
+	Handler func(req *http.Request, info *RequestInfo) R
+
+	// Whether the operation writes, even when it is a GET.
+	//
+	Writes bool
+}
+
+var Operations = make(map[string]Operation)
+
+// Splits an operation name off the end of a key, if the key's last segment
+// names one. A key that really does end in an operation's name can still be
+// reached by adding the "noop=true" parameter.
+//
+func SplitOperation(req *http.Request, key string) (k, op string) {
+	k = key
+	i := strings.LastIndex(key, "/")
+	if i < 1 || req.FormValue("noop") == "true" {
+		return
+	}
+	if _, ok := Operations[key[i+1:]]; ok {
+		k, op = key[:i], key[i+1:]
+	}
+	return
+}
+
+// Returns true if the request writes to Redis: any request other than a GET
+// or HEAD, and any that names an operation that writes.
+//
+func IsWrite(req *http.Request, info *RequestInfo) bool {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return true
+	}
+	return info != nil && Operations[info.Op].Writes
+}
+
+// Runs the operation the request names, if the request's method is one the
+// operation answers to.
+//
+func HandleOperation(req *http.Request, info *RequestInfo) (response R) {
+	op := Operations[info.Op]
+	for _, method := range op.Methods {
+		if method == req.Method {
+			response = op.Handler(req, info)
+			return
+		}
+	}
+	e := fmt.Sprintf("Method not allowed for %s.", info.Op)
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusMethodNotAllowed)
+	return
+}
+
+// Builds the response for an error from Redis. Errors replied by the server
+// are the client's fault: 409 when the key holds the wrong kind of value, and
+// 400 otherwise.
+//
+func ErrorResponse(err error) (response R) {
+	response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+	if e, ok := err.(redis.Error); ok {
+		if strings.HasPrefix(string(e), "WRONGTYPE") {
+			response = response.WithStatus(http.StatusConflict)
+		} else {
+			response = response.WithStatus(http.StatusBadRequest)
+		}
+	}
+	return
+}
+
+// Returns true if the error says the server doesn't know the command, as
+// older servers say of the commands added since.
+//
+func unknownCommand(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.Contains(strings.ToLower(string(e)), "unknown command")
+}
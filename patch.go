@@ -0,0 +1,389 @@
+// Provides functions related to partially updating existing keys.
+//
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Handles HTTP PATCH requests, which change part of a key, leaving the rest
+// of it as it is:
+//
+//   - lists have values appended (or prepended, with "side=left"),
+//   - sets and sorted sets have members added (or, for sorted sets, their
+//     scores updated),
+//   - hashes have a JSON object merged into them, and fields set to null
+//     removed,
+//   - strings have the value appended, or written at "offset"; strings
+//     holding JSON documents are patched with a JSON Merge Patch (RFC 7396)
+//     sent as "application/merge-patch+json", or a JSON Patch (RFC 6902)
+//     sent as "application/json-patch+json".
+//
+// The values are given as for PUT. A key that doesn't exist is created, as a
+// hash, unless "type" says otherwise (or the body is a document patch).
+//
+func HandlePatchOperation(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	ct := req.Header.Get("Content-Type")
+	mergePatch := strings.HasPrefix(ct, MergePatchType)
+	jsonPatch := strings.HasPrefix(ct, JSONPatchType)
+	if keytype == "none" {
+		keytype = req.FormValue("type")
+		if mergePatch || jsonPatch {
+			keytype = "string"
+		} else if len(keytype) == 0 {
+			keytype = "hash"
+		}
+	}
+
+	switch keytype {
+	case "hash":
+		response = patchHash(req, client, info.Key)
+
+	case "list", "set", "zset":
+		var elements []interface{}
+		if elements, response = RequestElements(req, keytype); response != nil {
+			return
+		}
+		if len(elements) == 0 {
+			e := "No values provided."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		cmd := elementCommands[keytype]
+		if keytype == "list" && req.FormValue("side") == "left" {
+			cmd = "LPUSH"
+		}
+		fmt.Println(cmd, info.Key, len(elements), "arguments")
+		_, err = client.Do(cmd, append([]interface{}{info.Key}, elements...)...)
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		response = R{"result": true, "error": nil}
+
+	case "string":
+		if !mergePatch && !jsonPatch {
+			response = patchString(req, client, info.Key)
+			return
+		}
+		// Document patches WATCH the key, so they need a connection of
+		// their own.
+		//
+		var dedicated redis.Conn
+		if dedicated, err = info.DedicatedDB(); err != nil {
+			response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+			return
+		}
+		defer dedicated.Close()
+		if mergePatch {
+			response = patchDocument(req, dedicated, info.Key)
+		} else {
+			response = patchJSONDocument(req, dedicated, info.Key)
+		}
+
+	default:
+		e := fmt.Sprintf("Cannot patch a %s.", keytype)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+	}
+	return
+}
+
+// The media type of JSON Merge Patch documents.
+//
+const MergePatchType = "application/merge-patch+json"
+
+// Appends to a string, or, with "offset", overwrites part of it.
+//
+func patchString(req *http.Request, client redis.Conn, key string) (response R) {
+	if _, ok := SchemaFor(key); ok {
+		e := "Keys with a schema can only be patched as JSON documents."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+		return
+	}
+	value, err := RequestValue(req)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	if len(value) == 0 {
+		e := "No values provided."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	if offset := req.FormValue("offset"); len(offset) > 0 {
+		i, err := strconv.Atoi(offset)
+		if err != nil || i < 0 {
+			e := fmt.Sprintf("Invalid offset: %s", offset)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		fmt.Println("SETRANGE", key, i)
+		_, err = client.Do("SETRANGE", key, i, value)
+	} else {
+		fmt.Println("APPEND", key)
+		_, err = client.Do("APPEND", key, value)
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": true, "error": nil}
+	return
+}
+
+// How many times a document is re-read and patched again, when somebody
+// else changes it in the middle of a patch.
+//
+const DocumentPatchAttempts = 5
+
+// Applies a JSON Merge Patch to the JSON document stored in a string. The
+// document is WATCHed while it is patched, so a concurrent change makes the
+// patch start over, rather than being lost. The key's TTL is kept.
+//
+func patchDocument(req *http.Request, client redis.Conn, key string) (response R) {
+	var patch interface{}
+	if err := decodeJSON(req.Body, &patch); err != nil {
+		e := fmt.Sprintf("Could not decode the merge patch: %s", err)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	for attempt := 0; attempt < DocumentPatchAttempts; attempt++ {
+		retry := false
+		response, retry = updateDocument(client, key, func(doc interface{}) (interface{}, R) {
+			return MergePatch(doc, patch), nil
+		})
+		if !retry {
+			return
+		}
+	}
+	e := "The document kept changing while it was being patched."
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+	return
+}
+
+// Reads the JSON document stored in a string (a missing key reads as null),
+// changes it with update, and writes it back in a transaction, keeping the
+// key's TTL. Returns retry if the document changed in the meantime.
+//
+func updateDocument(client redis.Conn, key string, update func(interface{}) (interface{}, R)) (response R, retry bool) {
+	defer client.Do("UNWATCH")
+	if _, err := client.Do("WATCH", key); err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+
+	var doc interface{}
+	stored, err := redis.Bytes(client.Do("GET", key))
+	if err != nil && err != redis.ErrNil {
+		response = ErrorResponse(err)
+		return
+	}
+	if err == nil {
+		if err = decodeJSON(bytes.NewReader(stored), &doc); err != nil {
+			e := "The key does not hold a JSON document."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+			return
+		}
+	}
+	ttl, err := redis.Int64(client.Do("PTTL", key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+
+	if doc, response = update(doc); response != nil {
+		return
+	}
+	if response = ValidateDocument(key, doc); response != nil {
+		return
+	}
+	b, err := json.Marshal(doc)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	commands := [][]interface{}{{"SET", key, b}}
+	if ttl > 0 {
+		commands = append(commands, []interface{}{"PEXPIRE", key, ttl})
+	}
+	fmt.Println("SET", key, len(b), "bytes")
+	_, err = transaction(client, commands)
+	if err == redis.ErrNil {
+		// EXEC was aborted: somebody else wrote to the key.
+		//
+		retry = true
+		return
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": doc, "error": nil}
+	return
+}
+
+// Applies a JSON Merge Patch (RFC 7396) to a decoded JSON document: objects
+// in the patch are merged into the document, members set to null are
+// removed, and anything else replaces what was there.
+//
+func MergePatch(doc, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	d, ok := doc.(map[string]interface{})
+	if !ok {
+		d = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(d, k)
+		} else {
+			d[k] = MergePatch(d[k], v)
+		}
+	}
+	return d
+}
+
+// Decodes JSON, keeping numbers as json.Number, so integers too big for a
+// float64 (IDs, counters) are written back exactly as they were.
+//
+func decodeJSON(r io.Reader, v interface{}) (err error) {
+	d := json.NewDecoder(r)
+	d.UseNumber()
+	if err = d.Decode(v); err != nil {
+		return
+	}
+	if _, extra := d.Token(); extra != io.EOF {
+		err = errors.New("unexpected data after the JSON value")
+	}
+	return
+}
+
+// Decodes a request body holding a JSON object.
+//
+func decodeObject(req *http.Request) (object map[string]interface{}, response R) {
+	if err := decodeJSON(req.Body, &object); err != nil || object == nil {
+		e := "The request body must be a JSON object."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+// Returns the string stored for a JSON value in a hash field: strings are
+// stored as they are, and everything else as JSON.
+//
+func fieldValue(v interface{}) (s string, err error) {
+	if str, ok := v.(string); ok {
+		s = str
+		return
+	}
+	b, err := json.Marshal(v)
+	s = string(b)
+	return
+}
+
+// Sets and removes hash fields in one go. ARGV[1] is how many fields are
+// set; it's followed by those fields and their values, and then by the
+// fields to remove.
+//
+var mergeHashScript = redis.NewScript(1, `
+local n = tonumber(ARGV[1])
+for i = 2, 2 * n, 2 do
+  redis.call('HSET', KEYS[1], ARGV[i], ARGV[i + 1])
+end
+for i = 2 * n + 2, #ARGV do
+  redis.call('HDEL', KEYS[1], ARGV[i])
+end
+return 1
+`)
+
+// Merges a JSON object into a hash, atomically. A script does the work, so
+// this runs on the request's shared connection, with no MULTI.
+//
+func patchHash(req *http.Request, client redis.Conn, key string) (response R) {
+	object, response := decodeObject(req)
+	if response != nil {
+		return
+	}
+
+	var set, del redis.Args
+	for _, field := range sortedKeys(object) {
+		if object[field] == nil {
+			del = del.Add(field)
+			continue
+		}
+		value, err := fieldValue(object[field])
+		if err != nil {
+			response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		set = set.Add(field, value)
+	}
+
+	println("HSET", key, len(set)/2, "fields, HDEL", len(del), "fields")
+	args := append(redis.Args{}.Add(key, len(set)/2), set...)
+	if _, err := mergeHashScript.Do(client, append(args, del...)...); err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": true, "error": nil}
+	return
+}
+
+// Runs commands (each one a command name followed by its arguments) in a
+// MULTI/EXEC transaction, on a connection of the request's own. Each command
+// is sent with Do, rather than pipelined, so that connection wrappers see
+// every one of them. Returns EXEC's replies, or the first error in them.
+//
+func transaction(client redis.Conn, commands [][]interface{}) (replies []interface{}, err error) {
+	if _, err = client.Do("MULTI"); err != nil {
+		return
+	}
+	for _, c := range commands {
+		if _, err = client.Do(c[0].(string), c[1:]...); err != nil {
+			client.Do("DISCARD")
+			return
+		}
+	}
+	if replies, err = redis.Values(client.Do("EXEC")); err != nil {
+		return
+	}
+	for _, r := range replies {
+		if e, ok := r.(redis.Error); ok {
+			err = e
+			return
+		}
+	}
+	return
+}
+
+func sortedKeys(m map[string]interface{}) (keys []string) {
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
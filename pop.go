@@ -0,0 +1,282 @@
+// pop.go
+//
+// Popping elements off lists, sets and sorted sets, optionally waiting for
+// one to arrive, so lists can be consumed as work queues by long-polling.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	Operations["pop"] = Operation{Methods: []string{"GET", "POST"}, Handler: HandlePop, Writes: true}
+	return
+}
+
+// How much of the request's deadline is kept back when waiting, so there is
+// time to answer once the wait is over.
+//
+const PopWaitMargin = time.Second
+
+// Handles GET (or POST) /{db}/{key}/pop, removing and returning an element:
+//
+//   - from a list, from the "side" given (left, by default), optionally
+//     pushing it onto the list named by "to", at its "toSide" (right, by
+//     default),
+//   - from a sorted set, the member with the lowest score, or with
+//     "end=max", the highest, along with its score,
+//   - from a set, a random member (see HandleSetPop).
+//
+// With "wait" (e.g. "30s", or a number of seconds), the request blocks until
+// there is something to pop, for up to that long, but never past the
+// request's deadline; if nothing turns up, the response is a 204. Without
+// it, an empty list or sorted set gets a 404. Waiting uses a connection of
+// the request's own, so the shared connection isn't held up.
+//
+// A key that doesn't exist yet is taken to be a list, unless "end" is given.
+//
+func HandlePop(req *http.Request, info *RequestInfo) (response R) {
+	wait, response := popWait(req, info)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	if keytype == "none" {
+		keytype = "list"
+		if len(req.FormValue("end")) > 0 {
+			keytype = "zset"
+		}
+	}
+
+	switch keytype {
+	case "list":
+		response = popList(req, info, wait)
+
+	case "zset":
+		response = popSortedSet(req, info, wait)
+
+	case "set":
+		if wait > 0 {
+			e := "Waiting is only supported for lists and sorted sets."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		response = HandleSetPop(req, info)
+
+	default:
+		e := fmt.Sprintf("Cannot pop from a %s.", keytype)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+	}
+	return
+}
+
+// Returns how long to wait for, from the "wait" parameter, cut short so it
+// ends before the request's deadline.
+//
+func popWait(req *http.Request, info *RequestInfo) (wait time.Duration, response R) {
+	w := req.FormValue("wait")
+	if len(w) == 0 {
+		return
+	}
+	wait, err := time.ParseDuration(w)
+	if err != nil {
+		secs, e := strconv.ParseFloat(w, 64)
+		wait, err = time.Duration(secs*float64(time.Second)), e
+	}
+	if err != nil || wait <= 0 {
+		e := fmt.Sprintf("Invalid wait: %s", w)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	if deadline, ok := info.ctx.Deadline(); ok {
+		if left := time.Until(deadline) - PopWaitMargin; left < wait {
+			wait = left
+		}
+	}
+	if wait <= 0 {
+		e := "The request's deadline leaves no time to wait."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+// Formats a wait as a blocking command's timeout. Whole seconds are used
+// where possible, since servers older than Redis 6.0 don't take fractions.
+// Zero means forever to Redis, so it is never returned.
+//
+func blockingTimeout(wait time.Duration) string {
+	if wait >= time.Second {
+		return strconv.FormatInt(int64(wait/time.Second), 10)
+	}
+	return strconv.FormatFloat(wait.Seconds(), 'f', 3, 64)
+}
+
+// Returns a connection for the pop: the shared one, or, when waiting, one of
+// the request's own, which is closed as soon as the request's context is
+// done, to cut the wait short. Call done when finished with it.
+//
+func popConn(info *RequestInfo, wait time.Duration) (client redis.Conn, done func(), err error) {
+	if wait <= 0 {
+		client, err = info.DB()
+		done = func() {}
+		return
+	}
+	if client, err = info.BlockingDB(wait); err != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(info.ctx)
+	go func() {
+		<-ctx.Done()
+		client.Close()
+	}()
+	done = cancel
+	return
+}
+
+func side(s, def string) (string, bool) {
+	switch strings.ToLower(s) {
+	case "":
+		return def, true
+	case "left":
+		return "LEFT", true
+	case "right":
+		return "RIGHT", true
+	}
+	return "", false
+}
+
+func popList(req *http.Request, info *RequestInfo, wait time.Duration) (response R) {
+	from, ok := side(req.FormValue("side"), "LEFT")
+	to, ok2 := side(req.FormValue("toSide"), "RIGHT")
+	if !ok || !ok2 {
+		e := "The \"side\" and \"toSide\" parameters must be left or right."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	dest := req.FormValue("to")
+
+	client, done, err := popConn(info, wait)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	defer done()
+
+	var reply interface{}
+	switch {
+	case wait <= 0 && len(dest) > 0:
+		println("LMOVE", info.Key, dest, from, to)
+		reply, err = client.Do("LMOVE", info.Key, dest, from, to)
+
+	case wait <= 0:
+		println(from[:1]+"POP", info.Key)
+		reply, err = client.Do(from[:1]+"POP", info.Key)
+
+	case len(dest) > 0:
+		timeout := blockingTimeout(wait)
+		println("BLMOVE", info.Key, dest, from, to, timeout)
+		reply, err = client.Do("BLMOVE", info.Key, dest, from, to, timeout)
+		if unknownCommand(err) && from == "RIGHT" && to == "LEFT" {
+			println("BRPOPLPUSH", info.Key, dest, timeout)
+			reply, err = client.Do("BRPOPLPUSH", info.Key, dest, timeout)
+		}
+
+	default:
+		timeout := blockingTimeout(wait)
+		println("B"+from[:1]+"POP", info.Key, timeout)
+		reply, err = client.Do("B"+from[:1]+"POP", info.Key, timeout)
+		if r, ok := reply.([]interface{}); ok && len(r) == 2 {
+			// BLPOP and BRPOP reply with the key, then the element.
+			//
+			reply = r[1]
+		}
+	}
+	if unknownCommand(err) {
+		e := "Moving elements between lists this way needs Redis 6.2 or later."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotImplemented)
+		return
+	}
+	element, err := redis.String(reply, err)
+	response = popped(element, err, wait)
+	return
+}
+
+func popSortedSet(req *http.Request, info *RequestInfo, wait time.Duration) (response R) {
+	cmd := "ZPOPMIN"
+	switch strings.ToLower(req.FormValue("end")) {
+	case "", "min":
+	case "max":
+		cmd = "ZPOPMAX"
+	default:
+		e := "The \"end\" parameter must be min or max."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, done, err := popConn(info, wait)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	defer done()
+
+	var reply []interface{}
+	if wait > 0 {
+		timeout := blockingTimeout(wait)
+		println("B"+cmd, info.Key, timeout)
+		reply, err = redis.Values(client.Do("B"+cmd, info.Key, timeout))
+		if len(reply) == 3 {
+			// BZPOPMIN and BZPOPMAX reply with the key first.
+			//
+			reply = reply[1:]
+		}
+	} else {
+		println(cmd, info.Key)
+		reply, err = redis.Values(client.Do(cmd, info.Key))
+	}
+	if err == nil && len(reply) < 2 {
+		err = redis.ErrNil
+	}
+	if err != nil {
+		response = popped("", err, wait)
+		return
+	}
+	member, _ := redis.String(reply[0], nil)
+	score, _ := redis.Float64(reply[1], nil)
+	response = R{"result": R{"member": member, "score": score}, "error": nil}
+	return
+}
+
+// Builds the response to a pop: the element, or if there was none, a 204
+// when waiting (the wait timed out), or a 404 otherwise.
+//
+func popped(element string, err error, wait time.Duration) (response R) {
+	switch {
+	case err == redis.ErrNil && wait > 0:
+		response = R{"result": nil, "error": nil}.WithStatus(http.StatusNoContent)
+	case err == redis.ErrNil:
+		e := "There is nothing to pop."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+	case err != nil:
+		response = ErrorResponse(err)
+	default:
+		response = R{"result": element, "error": nil}
+	}
+	return
+}
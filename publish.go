@@ -0,0 +1,40 @@
+// publish.go
+//
+// Publishing messages to Redis Pub/Sub channels.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+)
+
+func init() {
+	Operations["publish"] = Operation{Methods: []string{"POST"}, Handler: HandlePublish}
+	return
+}
+
+// Handles POST /{db}/{channel}/publish, publishing the request's value on
+// the channel. The result is the number of clients that received it.
+//
+func HandlePublish(req *http.Request, info *RequestInfo) (response R) {
+	value, err := RequestValue(req)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("PUBLISH", info.Key)
+	n, err := redis.Int(client.Do("PUBLISH", info.Key, value))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
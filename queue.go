@@ -0,0 +1,515 @@
+// queue.go
+//
+// Reliable job queues, under /_queues/{name}. Dequeued jobs are held in
+// flight until they are acknowledged; jobs that aren't acknowledged within
+// their visibility timeout are delivered again by a background reaper, until
+// they run out of attempts and are moved to the queue's dead-letter list.
+//
+// Every queue's keys share the hash tag {name}, so a queue lives on a single
+// node of a cluster (or shard), and its scripts can touch all of them:
+//
+//	scarlet:queue:{name}:seq       job id counter
+//	scarlet:queue:{name}:jobs      hash of job id -> {"priority", "attempts",
+//	                               "enqueued"} (JSON)
+//	scarlet:queue:{name}:payloads  hash of job id -> payload
+//	scarlet:queue:{name}:ready     sorted set of jobs waiting to be dequeued,
+//	                               highest priority, then oldest, first
+//	scarlet:queue:{name}:delayed   sorted set of delayed jobs, by due time
+//	scarlet:queue:{name}:inflight  sorted set of dequeued jobs, by the time
+//	                               their visibility timeout runs out
+//	scarlet:queue:{name}:dead      list of ids of jobs out of attempts
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultQueueVisibility   = 30 * time.Second
+	DefaultQueueReapInterval = time.Second
+	DefaultQueueMaxAttempts  = 5
+
+	// Priorities run from 0 (the default) to MaxQueuePriority; higher ones
+	// are dequeued first.
+	//
+	MaxQueuePriority = 9
+
+	// The set of every queue's key base, so the reaper can find them.
+	//
+	QueueRegistryKey = "scarlet:queues"
+)
+
+// The names queues (and other named resources) may have. They end up inside a hash tag, so
+// they can't contain braces.
+//
+var ResourceNameRegex = regexp.MustCompile(`^[A-Za-z0-9_.:-]+$`)
+
+// Returns the prefix of a queue's keys.
+//
+func queueBase(name string) string {
+	return "scarlet:queue:{" + name + "}"
+}
+
+// The time, in milliseconds, as the queue scripts are given it.
+//
+func queueNow() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func queueKeys(name string, suffixes ...string) (keys []interface{}) {
+	for _, s := range suffixes {
+		keys = append(keys, queueBase(name)+":"+s)
+	}
+	return
+}
+
+// The Lua helpers shared by the scripts: the ready-set score for a job,
+// which puts higher priorities first, and older jobs first within a
+// priority, and putting a job back on the queue.
+//
+// The scripts are given the time (in milliseconds) rather than calling TIME:
+// servers before Redis 5 refuse writes from a script once it has called it.
+//
+const queueLuaHelpers = `
+local function readyScore(priority, at)
+  return (9 - priority) * 1e13 + at
+end
+local function requeue(ready, delayed, id, job, delay, at)
+  if delay > 0 then
+    redis.call('ZADD', delayed, at + delay, id)
+  else
+    redis.call('ZADD', ready, readyScore(job.priority, at), id)
+  end
+end
+`
+
+// KEYS: seq, jobs, payloads, ready, delayed
+// ARGV: payload, priority, delay (ms), now (ms)
+//
+var enqueueScript = redis.NewScript(5, queueLuaHelpers+`
+local at = tonumber(ARGV[4])
+local id = tostring(redis.call('INCR', KEYS[1]))
+local job = {priority = tonumber(ARGV[2]), attempts = 0, enqueued = at}
+redis.call('HSET', KEYS[2], id, cjson.encode(job))
+redis.call('HSET', KEYS[3], id, ARGV[1])
+requeue(KEYS[4], KEYS[5], id, job, tonumber(ARGV[3]), at)
+return id
+`)
+
+// KEYS: ready, inflight, jobs, payloads
+// ARGV: visibility timeout (ms), now (ms)
+//
+var dequeueScript = redis.NewScript(4, queueLuaHelpers+`
+local ids = redis.call('ZRANGE', KEYS[1], 0, 0)
+if #ids == 0 then
+  return false
+end
+local id = ids[1]
+redis.call('ZREM', KEYS[1], id)
+redis.call('ZADD', KEYS[2], tonumber(ARGV[2]) + tonumber(ARGV[1]), id)
+local job = cjson.decode(redis.call('HGET', KEYS[3], id))
+job.attempts = job.attempts + 1
+redis.call('HSET', KEYS[3], id, cjson.encode(job))
+return {id, job.attempts, redis.call('HGET', KEYS[4], id)}
+`)
+
+// KEYS: inflight, jobs, payloads
+// ARGV: id
+//
+var ackScript = redis.NewScript(3, `
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+  return 0
+end
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return 1
+`)
+
+// Returns 0 if the job wasn't in flight, 1 if it was put back on the queue,
+// and 2 if it ran out of attempts and is now dead.
+//
+// KEYS: inflight, ready, delayed, jobs, dead
+// ARGV: id, delay (ms), max attempts, now (ms)
+//
+var nackScript = redis.NewScript(5, queueLuaHelpers+`
+local id = ARGV[1]
+if redis.call('ZREM', KEYS[1], id) == 0 then
+  return 0
+end
+local job = cjson.decode(redis.call('HGET', KEYS[4], id))
+if job.attempts >= tonumber(ARGV[3]) then
+  redis.call('RPUSH', KEYS[5], id)
+  return 2
+end
+requeue(KEYS[2], KEYS[3], id, job, tonumber(ARGV[2]), tonumber(ARGV[4]))
+return 1
+`)
+
+// Puts jobs whose visibility timeout has run out back on the queue (or in
+// the dead-letter list), and moves delayed jobs that are due onto the queue.
+// Returns how many jobs were redelivered, and how many died.
+//
+// KEYS: inflight, ready, delayed, jobs, dead
+// ARGV: max attempts, how many jobs to look at, now (ms)
+//
+var reapScript = redis.NewScript(5, queueLuaHelpers+`
+local at = tonumber(ARGV[3])
+local limit = tonumber(ARGV[2])
+local redelivered, died = 0, 0
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', at, 'LIMIT', 0, limit)) do
+  redis.call('ZREM', KEYS[1], id)
+  local job = cjson.decode(redis.call('HGET', KEYS[4], id))
+  if job.attempts >= tonumber(ARGV[1]) then
+    redis.call('RPUSH', KEYS[5], id)
+    died = died + 1
+  else
+    requeue(KEYS[2], KEYS[3], id, job, 0, at)
+    redelivered = redelivered + 1
+  end
+end
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', at, 'LIMIT', 0, limit)) do
+  redis.call('ZREM', KEYS[3], id)
+  local job = cjson.decode(redis.call('HGET', KEYS[4], id))
+  requeue(KEYS[2], KEYS[3], id, job, 0, at)
+end
+return {redelivered, died}
+`)
+
+// Handles every request under /_queues/:
+//
+//	POST /_queues/{name}                enqueue the value, optionally with a
+//	                                    "delay" and a "priority" (0-9)
+//	POST /_queues/{name}/dequeue        take the next job, in flight for
+//	                                    "visibility" (or the default)
+//	POST /_queues/{name}/ack/{id}       finish a job
+//	POST /_queues/{name}/nack/{id}      give a job back, optionally after a
+//	                                    "delay"
+//	GET  /_queues/{name}                the number of jobs in each state
+//	GET  /_queues/{name}/dead           the jobs in the dead-letter list
+//
+// Queues are kept in the database set by queues.database on the default
+// upstream, and the same checks apply as to any other request for it.
+//
+func QueueHandler(rw http.ResponseWriter, req *http.Request) {
+	if !config.Queues.Enabled {
+		http.NotFound(rw, req)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/_queues/"), "/")
+	name := parts[0]
+	if !ResourceNameRegex.MatchString(name) {
+		e := fmt.Sprintf("Invalid queue name: %q", name)
+		WriteResponse(rw, req, R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest))
+		return
+	}
+
+	info := &RequestInfo{DbNum: config.Queues.Database, Tenant: TenantFor(req), ctx: req.Context()}
+	defer info.Close()
+	if response, denied := CheckRequest(rw, req, info); denied {
+		WriteResponse(rw, req, response)
+		return
+	}
+
+	var response R
+	action := strings.Join(parts[1:], "/")
+	switch {
+	case req.Method == "POST" && action == "":
+		response = Enqueue(req, info, name)
+	case req.Method == "POST" && action == "dequeue":
+		response = Dequeue(req, info, name)
+	case req.Method == "POST" && len(parts) == 3 && (parts[1] == "ack" || parts[1] == "nack"):
+		response = Acknowledge(req, info, name, parts[1] == "ack", parts[2])
+	case req.Method == "GET" && action == "":
+		response = QueueStats(info, name)
+	case req.Method == "GET" && action == "dead":
+		response = DeadJobs(info, name)
+	default:
+		e := "Not found."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+	}
+	WriteResponse(rw, req, response)
+	return
+}
+
+// Parses a duration parameter, given as a duration ("30s") or in seconds.
+//
+func durationParam(req *http.Request, name string, def time.Duration) (d time.Duration, response R) {
+	v := req.FormValue(name)
+	if len(v) == 0 {
+		d = def
+		return
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		secs, e := strconv.ParseFloat(v, 64)
+		d, err = time.Duration(secs*float64(time.Second)), e
+	}
+	if err != nil || d < 0 {
+		e := fmt.Sprintf("The %q parameter must be a duration, like \"30s\".", name)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+	}
+	return
+}
+
+// Adds a job to a queue, and returns its id.
+//
+func Enqueue(req *http.Request, info *RequestInfo, name string) (response R) {
+	payload, err := RequestValue(req)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	delay, response := durationParam(req, "delay", 0)
+	if response != nil {
+		return
+	}
+	priority := 0
+	if p := req.FormValue("priority"); len(p) > 0 {
+		if priority, err = strconv.Atoi(p); err != nil || priority < 0 || priority > MaxQueuePriority {
+			e := fmt.Sprintf("The \"priority\" parameter must be between 0 and %d.", MaxQueuePriority)
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	if err = registerQueue(info, name); err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	keys := queueKeys(name, "seq", "jobs", "payloads", "ready", "delayed")
+	args := append(keys, payload, priority, int64(delay/time.Millisecond), queueNow())
+	id, err := redis.String(enqueueScript.Do(client, args...))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	println("ENQUEUE", name, id)
+	response = R{"result": id, "error": nil}.WithStatus(http.StatusCreated)
+	return
+}
+
+// Records a queue in the registry, so the reaper looks after it. The
+// registry isn't a tenant's; it holds the queue's full key base, including
+// any tenant prefix. So it is written on the request's pooled connection
+// itself, rather than through the tenant's wrapper around it.
+//
+func registerQueue(info *RequestInfo, name string) (err error) {
+	if _, err = info.DB(); err != nil {
+		return
+	}
+	base := queueBase(name)
+	if info.Tenant != nil {
+		base = info.Tenant.Prefix + base
+	}
+	_, err = info.conn.Do("SADD", QueueRegistryKey, base)
+	return
+}
+
+// Takes the next job off a queue, and holds it in flight until it is
+// acknowledged, or its visibility timeout runs out. Responds with a 204 if
+// the queue is empty.
+//
+func Dequeue(req *http.Request, info *RequestInfo, name string) (response R) {
+	def, _ := parseDuration(config.Queues.VisibilityTimeout, DefaultQueueVisibility)
+	visibility, response := durationParam(req, "visibility", def)
+	if response != nil {
+		return
+	}
+	if visibility <= 0 {
+		e := "The \"visibility\" parameter must be positive."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	keys := queueKeys(name, "ready", "inflight", "jobs", "payloads")
+	args := append(keys, int64(visibility/time.Millisecond), queueNow())
+	reply, err := redis.Values(dequeueScript.Do(client, args...))
+	if err == redis.ErrNil {
+		response = R{"result": nil, "error": nil}.WithStatus(http.StatusNoContent)
+		return
+	}
+	if err == nil && len(reply) != 3 {
+		err = fmt.Errorf("Unexpected reply from the dequeue script")
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	var id, payload string
+	var attempts int
+	if _, err = redis.Scan(reply, &id, &attempts, &payload); err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("DEQUEUE", name, id)
+	response = R{
+		"result":   payload,
+		"id":       id,
+		"attempts": attempts,
+		"expires":  time.Now().Add(visibility).UTC().Format(time.RFC3339),
+		"error":    nil,
+	}
+	return
+}
+
+// Acknowledges (ack) or gives back (nack) an in-flight job. Responds with a
+// 404 if the job isn't in flight, which happens when its visibility timeout
+// ran out first.
+//
+func Acknowledge(req *http.Request, info *RequestInfo, name string, ack bool, id string) (response R) {
+	delay, response := durationParam(req, "delay", 0)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+
+	var n int
+	if ack {
+		println("ACK", name, id)
+		keys := queueKeys(name, "inflight", "jobs", "payloads")
+		n, err = redis.Int(ackScript.Do(client, append(keys, id)...))
+	} else {
+		println("NACK", name, id)
+		keys := queueKeys(name, "inflight", "ready", "delayed", "jobs", "dead")
+		args := append(keys, id, int64(delay/time.Millisecond), config.Queues.maxAttempts(), queueNow())
+		n, err = redis.Int(nackScript.Do(client, args...))
+	}
+	switch {
+	case err != nil:
+		response = ErrorResponse(err)
+	case n == 0:
+		e := fmt.Sprintf("Job %s is not in flight.", id)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+	case n == 2:
+		response = R{"result": "dead", "error": nil}
+	case ack:
+		response = R{"result": "done", "error": nil}
+	default:
+		response = R{"result": "requeued", "error": nil}
+	}
+	return
+}
+
+// Returns the number of jobs in each state.
+//
+func QueueStats(info *RequestInfo, name string) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	stats := make(map[string]int64)
+	counts := []struct{ state, cmd string }{
+		{"ready", "ZCARD"}, {"delayed", "ZCARD"}, {"inflight", "ZCARD"}, {"dead", "LLEN"},
+	}
+	for _, c := range counts {
+		if stats[c.state], err = redis.Int64(client.Do(c.cmd, queueKeys(name, c.state)[0])); err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+	}
+	response = R{"result": stats, "error": nil}
+	return
+}
+
+// Returns the jobs in a queue's dead-letter list (up to the first 100), with
+// their payloads and how many times they were attempted.
+//
+func DeadJobs(info *RequestInfo, name string) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	keys := queueKeys(name, "dead", "jobs", "payloads")
+	ids, err := redis.Strings(client.Do("LRANGE", keys[0], 0, 99))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	jobs := []R{}
+	for _, id := range ids {
+		meta, _ := redis.Bytes(client.Do("HGET", keys[1], id))
+		payload, _ := redis.String(client.Do("HGET", keys[2], id))
+		var job struct {
+			Attempts int   `json:"attempts"`
+			Enqueued int64 `json:"enqueued"`
+		}
+		json.Unmarshal(meta, &job)
+		jobs = append(jobs, R{
+			"id":       id,
+			"payload":  payload,
+			"attempts": job.Attempts,
+			"enqueued": time.Unix(0, job.Enqueued*int64(time.Millisecond)).UTC().Format(time.RFC3339),
+		})
+	}
+	response = R{"result": jobs, "error": nil}
+	return
+}
+
+// Every ReapInterval, redelivers jobs whose visibility timeout has run out,
+// and releases delayed jobs that are due, across every queue. The reaper
+// pauses while the queues' database is read-only. This never returns; run it
+// in its own goroutine.
+//
+func ReapQueues(cm *ConnectionMap) {
+	interval, _ := parseDuration(config.Queues.ReapInterval, DefaultQueueReapInterval)
+	for {
+		time.Sleep(interval)
+		if err := reapQueues(cm); err != nil {
+			println("QUEUE", "reaper error:", err.Error())
+		}
+	}
+}
+
+func reapQueues(cm *ConnectionMap) (err error) {
+	if ReadOnly.Is(strconv.Itoa(config.Queues.Database)) {
+		return
+	}
+	conn, err := cm.Get(config.Queues.Database)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	bases, err := redis.Strings(conn.Do("SMEMBERS", QueueRegistryKey))
+	if err != nil {
+		return
+	}
+	for _, base := range bases {
+		var keys []interface{}
+		for _, s := range []string{"inflight", "ready", "delayed", "jobs", "dead"} {
+			keys = append(keys, base+":"+s)
+		}
+		var counts []int
+		args := append(keys, config.Queues.maxAttempts(), 1000, queueNow())
+		counts, err = redis.Ints(reapScript.Do(conn, args...))
+		if err != nil {
+			return
+		}
+		if len(counts) == 2 && counts[0]+counts[1] > 0 {
+			println("QUEUE", base, "redelivered", counts[0], "dead", counts[1])
+		}
+	}
+	return
+}
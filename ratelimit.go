@@ -0,0 +1,239 @@
+// ratelimit.go
+//
+// Token-bucket rate limiting, per API key, per source address and per
+// database, with separate buckets for reads and writes.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Limiter hands out tokens from named buckets.
+//
+type Limiter interface {
+	// Takes a token from the bucket. If there are none left, ok is false,
+	// and retry says how long it will be until there is one.
+	//
+	Take(bucket string, l Limit) (ok bool, retry time.Duration, err error)
+}
+
+// The limiter used by DispatchRequest; nil when rate limiting is disabled.
+//
+var RateLimiter Limiter
+
+// Creates the limiter described by the configuration.
+//
+func NewLimiter(conf RateLimitBlock, cm *ConnectionMap) (l Limiter) {
+	if !conf.Enabled {
+		return
+	}
+	if conf.Shared {
+		l = &redisLimiter{cm: cm}
+	} else {
+		l = &memoryLimiter{buckets: make(map[string]*tokenBucket)}
+	}
+	return
+}
+
+// Checks the request against every limit that applies to it. If any bucket
+// is empty, a 429 response is returned, and the Retry-After header is set
+// to the longest wait. Errors talking to the limiter's storage are logged,
+// and the request is let through.
+//
+func CheckRateLimit(rw http.ResponseWriter, req *http.Request, info *RequestInfo) (response R, limited bool) {
+	if RateLimiter == nil {
+		return
+	}
+	conf := config.RateLimit
+
+	kind, pick := "write", func(l Limits) Limit { return l.Writes }
+	if !IsWrite(req, info) {
+		kind, pick = "read", func(l Limits) Limit { return l.Reads }
+	}
+
+	buckets := map[string]Limit{}
+	if key := APIKey(req); len(key) > 0 {
+		buckets["key:"+key+":"+kind] = pick(conf.APIKey.For(key))
+	}
+	addr := SourceAddress(req, conf.TrustForwardedFor)
+	buckets["ip:"+addr+":"+kind] = pick(conf.IP.For(addr))
+	db := info.DatabaseName()
+	buckets["db:"+db+":"+kind] = pick(conf.Database.For(db))
+
+	var wait time.Duration
+	for bucket, limit := range buckets {
+		if limit.Rate <= 0 {
+			continue
+		}
+		ok, retry, err := RateLimiter.Take(bucket, limit)
+		if err != nil {
+			println("RATELIMIT", "error:", err.Error())
+			continue
+		}
+		if !ok {
+			limited = true
+			if retry > wait {
+				wait = retry
+			}
+		}
+	}
+
+	if limited {
+		secs := int(math.Ceil(wait.Seconds()))
+		if secs < 1 {
+			secs = 1
+		}
+		println("RATELIMIT", addr, req.Method, req.URL.Path)
+		rw.Header().Set("Retry-After", strconv.Itoa(secs))
+		e := fmt.Sprintf("Rate limit exceeded; retry in %d seconds.", secs)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusTooManyRequests)
+	}
+	return
+}
+
+// Returns the address the request came from.
+//
+func SourceAddress(req *http.Request, trustForwardedFor bool) (addr string) {
+	if trustForwardedFor {
+		if fwd := req.Header.Get("X-Forwarded-For"); len(fwd) > 0 {
+			addr = strings.TrimSpace(strings.Split(fwd, ",")[0])
+			return
+		}
+	}
+	addr, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		addr = req.RemoteAddr
+	}
+	return
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// A memoryLimiter keeps its buckets in memory, so limits only apply to this
+// instance of Scarlet.
+//
+type memoryLimiter struct {
+	sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+func (m *memoryLimiter) Take(bucket string, l Limit) (ok bool, retry time.Duration, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	burst := math.Max(l.Burst, 1)
+	b, exists := m.buckets[bucket]
+	if !exists {
+		b = &tokenBucket{tokens: burst, last: now}
+		m.buckets[bucket] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.Rate)
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		ok = true
+	} else {
+		retry = time.Duration((1 - b.tokens) / l.Rate * float64(time.Second))
+	}
+
+	// Every so often, forget about buckets that haven't been touched in a
+	// while, so clients that have gone away don't hang around forever.
+	//
+	if now.Sub(m.swept) > time.Minute {
+		for name, b := range m.buckets {
+			if now.Sub(b.last) > 10*time.Minute {
+				delete(m.buckets, name)
+			}
+		}
+		m.swept = now
+	}
+	return
+}
+
+// Refills and takes a token from a bucket stored as a hash. Returns whether a
+// token was taken, and how many seconds to wait if not.
+//
+// The time is passed in, rather than read with TIME: servers before Redis 5
+// refuse writes from a script once it has called TIME. Instances sharing
+// the buckets should keep their clocks in sync; an instance whose clock is
+// behind never takes time away from a bucket.
+//
+var takeTokenScript = redis.NewScript(1, `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+now = math.max(now, ts)
+tokens = math.min(burst, tokens + (now - ts) * rate)
+local ok, wait = 0, 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  ok = 1
+else
+  wait = (1 - tokens) / rate
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {ok, tostring(wait)}
+`)
+
+// A redisLimiter keeps its buckets in Redis, so several instances of Scarlet
+// pointed at the same server share them. It uses its own connection, so it
+// doesn't get in the way of the requests it is limiting. The connection is
+// always to the master, since replicas can't be written to.
+//
+type redisLimiter struct {
+	sync.Mutex
+	cm   *ConnectionMap
+	conn redis.Conn
+}
+
+func (r *redisLimiter) Take(bucket string, l Limit) (ok bool, retry time.Duration, err error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.conn == nil {
+		if r.conn, err = r.cm.DialMaster(0); err != nil {
+			r.conn = nil
+			return
+		}
+	}
+
+	burst := math.Max(l.Burst, 1)
+	reply, err := redis.Values(takeTokenScript.Do(r.conn, "scarlet:ratelimit:"+bucket, l.Rate, burst, float64(time.Now().UnixNano())/1e9))
+	if err != nil {
+		// Start over with a fresh connection next time.
+		//
+		r.conn.Close()
+		r.conn = nil
+		return
+	}
+
+	var taken int
+	var wait string
+	if _, err = redis.Scan(reply, &taken, &wait); err != nil {
+		return
+	}
+	ok = taken == 1
+	if secs, e := strconv.ParseFloat(wait, 64); e == nil {
+		retry = time.Duration(secs * float64(time.Second))
+	}
+	return
+}
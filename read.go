@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"net/http"
+	"strings"
 )
 
 // Handles HTTP GET requests, which are intended for retrieving data.
@@ -13,7 +14,7 @@ import (
 func HandleReadOperation(req *http.Request, info *RequestInfo) (response R) {
 	// Get a Redis client for the specified database number.
 	//
-	client, err := Database.DB(info.DbNum)
+	client, err := info.DB()
 
 	// Parse out the key name
 	//
@@ -23,16 +24,11 @@ func HandleReadOperation(req *http.Request, info *RequestInfo) (response R) {
 		// of the keys in the database.
 		//
 		fmt.Println("KEYS", "*")
-		v, err := redis.Values(client.Do("KEYS", "*"))
+		keys, err := redis.Strings(client.Do("KEYS", "*"))
 		if err != nil {
 			response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
 			return
 		}
-
-		var keys = make([]string, 0)
-		for i := 0; i < len(v); i++ {
-			keys = append(keys, fmt.Sprintf("%s", v[i]))
-		}
 		response = R{"result": keys, "error": nil}
 		return
 	}
@@ -57,51 +53,65 @@ func HandleReadOperation(req *http.Request, info *RequestInfo) (response R) {
 	//
 	switch keyType {
 	case "string":
+		if path := req.FormValue("path"); len(path) > 0 {
+			response = ReadDocumentPath(client, key, path)
+			return
+		}
 		println("GET", key)
 		r, _ := redis.String(client.Do("GET", key))
+		if IsHyperLogLog(r) && req.FormValue("hll") != "false" {
+			// A HyperLogLog's bytes mean nothing to anybody; return its
+			// cardinality instead. A string that only looks like one makes
+			// PFCOUNT fail, and is returned as it is.
+			//
+			if response = ReadHyperLogLog(client, key); response["error"] == nil {
+				return
+			}
+		}
 		response = R{"result": r, "error": nil}
 
 	case "set":
 		println("SMEMBERS", key)
-		v, _ := redis.Values(client.Do("SMEMBERS", key))
-		var r []string
-		for i := 0; i < len(v); i++ {
-			r = append(r, fmt.Sprintf("%s", v[i]))
-		}
+		r, _ := redis.Strings(client.Do("SMEMBERS", key))
 		response = R{"result": r, "error": nil}
 
 	case "zset":
 		println("ZRANGE", key, 0, -1)
-		v, _ := redis.Values(client.Do("ZRANGE", key, 0, -1))
-		var r []string
-		for i := 0; i < len(v); i++ {
-			r = append(r, fmt.Sprintf("%s", v[i]))
+		r, _ := redis.Strings(client.Do("ZRANGE", key, 0, -1))
+		if req.FormValue("geo") == "true" {
+			// The sorted set is a geo set; return its locations.
+			//
+			response = GeoFeatures(client, key, r)
+			return
 		}
 		response = R{"result": r, "error": nil}
 
 	case "list":
 		println("LRANGE", key, 0, -1)
-		v, _ := redis.Values(client.Do("LRANGE", key, 0, -1))
-		var r []string
-		for i := 0; i < len(v); i++ {
-			r = append(r, fmt.Sprintf("%s", v[i]))
-		}
+		r, _ := redis.Strings(client.Do("LRANGE", key, 0, -1))
 		response = R{"result": r, "error": nil}
 
 	case "hash":
-		if field := req.FormValue("field"); field != "" {
+		req.ParseForm()
+		if fields := req.Form["field"]; len(fields) > 1 {
+			// Only the fields that exist are included in the result.
+			//
+			println("HMGET", key, strings.Join(fields, " "))
+			values, _ := redis.Values(client.Do("HMGET", redis.Args{}.Add(key).AddFlat(fields)...))
+			r := make(map[string]string)
+			for i, v := range values {
+				if s, err := redis.String(v, nil); err == nil && i < len(fields) {
+					r[fields[i]] = s
+				}
+			}
+			response = R{"result": r, "error": nil}
+		} else if field := req.FormValue("field"); field != "" {
 			println("HGET", key, field)
 			r, _ := redis.String(client.Do("HGET", key, field))
 			response = R{"result": r, "error": nil}
 		} else {
 			println("HGETALL", key)
-			v, _ := redis.Values(client.Do("HGETALL", key))
-			var r = make(map[string]string)
-			for i := 0; i < len(v); i += 2 {
-				key := fmt.Sprintf("%s", v[i])
-				val := fmt.Sprintf("%s", v[i+1])
-				r[key] = val
-			}
+			r, _ := redis.StringMap(client.Do("HGETALL", key))
 			response = R{"result": r, "error": nil}
 		}
 
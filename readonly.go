@@ -0,0 +1,160 @@
+// readonly.go
+//
+// Read-only mode: requests that would write to Redis are turned away before
+// they reach a handler, either everywhere, or only for some databases. The
+// mode starts out as configured, and can be changed at runtime through
+// /_admin/readonly.
+//
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+type readOnlyState struct {
+	sync.Mutex
+	loaded bool
+	all    bool
+	dbs    map[string]bool
+}
+
+var ReadOnly readOnlyState
+
+// Loads the initial state from the configuration, the first time it is needed.
+// The caller must hold the lock.
+//
+func (s *readOnlyState) load() {
+	if s.loaded {
+		return
+	}
+	s.all = config.ReadOnly.Enabled
+	s.dbs = make(map[string]bool)
+	for _, db := range config.ReadOnly.Databases {
+		s.dbs[db] = true
+	}
+	s.loaded = true
+	return
+}
+
+// Returns whether a database (named as by RequestInfo.DatabaseName) is
+// read-only.
+//
+func (s *readOnlyState) Is(db string) (p bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	p = s.all || s.dbs[db]
+	return
+}
+
+// Turns read-only mode on or off; everywhere if db is empty, or otherwise
+// for that one database.
+//
+func (s *readOnlyState) Set(db string, enabled bool) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	if len(db) == 0 {
+		s.all = enabled
+	} else if enabled {
+		s.dbs[db] = true
+	} else {
+		delete(s.dbs, db)
+	}
+	return
+}
+
+// Describes the current state, for the admin endpoint.
+//
+func (s *readOnlyState) Result() (result R) {
+	s.Lock()
+	defer s.Unlock()
+	s.load()
+	dbs := []string{}
+	for db := range s.dbs {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+	result = R{
+		"readOnly":     s.all,
+		"databases":    dbs,
+		"replicasOnly": config.ReadOnly.ReplicasOnly,
+	}
+	return
+}
+
+// Turns away requests that would write to a read-only database.
+//
+func CheckReadOnly(req *http.Request, info *RequestInfo) (response R, denied bool) {
+	if !IsWrite(req, info) {
+		return
+	}
+	if db := info.DatabaseName(); ReadOnly.Is(db) {
+		e := fmt.Sprintf("Database %s is read-only.", db)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusForbidden)
+		denied = true
+	}
+	return
+}
+
+// Checks that the request carries one of the admin API keys. When none are
+// configured, the admin endpoints are disabled.
+//
+func CheckAdmin(req *http.Request) (response R, denied bool) {
+	key := APIKey(req)
+	for _, k := range config.AdminKeys {
+		if len(key) > 0 && k == key {
+			return
+		}
+	}
+	e := "An admin API key is required."
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusForbidden)
+	denied = true
+	return
+}
+
+// Shows (GET) or changes (PUT or POST) the read-only mode. Changes take an
+// "enabled" parameter, and an optional "db" parameter naming a single
+// database ("3", or "{upstream}/3").
+//
+func ReadOnlyHandler(rw http.ResponseWriter, req *http.Request) {
+	if response, denied := CheckAdmin(req); denied {
+		WriteResponse(rw, req, response)
+		return
+	}
+
+	var response R
+	switch req.Method {
+	case "GET":
+		response = R{"result": ReadOnly.Result(), "error": nil}
+
+	case "PUT", "POST":
+		enabled, err := strconv.ParseBool(req.FormValue("enabled"))
+		if err != nil {
+			e := "The \"enabled\" parameter must be true or false."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			break
+		}
+		db := req.FormValue("db")
+		if !enabled && len(db) == 0 && config.ReadOnly.ReplicasOnly {
+			// We are connected to replicas; writes would fail anyway.
+			//
+			e := "Read-only mode can't be turned off while reading from replicas."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusConflict)
+			break
+		}
+		ReadOnly.Set(db, enabled)
+		println("READONLY", db, enabled)
+		response = R{"result": ReadOnly.Result(), "error": nil}
+
+	default:
+		e := "Method not allowed."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusMethodNotAllowed)
+	}
+	WriteResponse(rw, req, response)
+	return
+}
@@ -6,22 +6,35 @@ package main
 
 import (
 	"errors"
-	//	"fmt"
+	"fmt"
 	"github.com/garyburd/redigo/redis"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	InfoDbRegex = regexp.MustCompile(`db(\d{1,3})`)
 )
 
+const (
+	// How many connections to each database a ConnectionMap's pools hold,
+	// unless the upstream's poolSize says otherwise.
+	//
+	DefaultPoolSize = 16
+
+	// Idle pooled connections are closed after this long.
+	//
+	PoolIdleTimeout = 5 * time.Minute
+)
+
 // An idiomatic function to create a new connection to a Redis host, and
 // subsequently authenticate, and select a database.
 //
-func ConnectToRedisHost(addr, password string, db interface{}) (c redis.Conn, err error) {
-	conn, e := redis.Dial("tcp", addr)
+func ConnectToRedisHost(addr, password string, db interface{}, t RedisTimeouts) (c redis.Conn, err error) {
+	conn, e := redis.DialTimeout("tcp", addr, t.Connect, t.Read, t.Write)
 	if e != nil {
 		err = e
 		return
@@ -63,16 +76,100 @@ func ConnectToRedisHost(addr, password string, db interface{}) (c redis.Conn, er
 // host, and get the appropriate connection for the incoming HTTP request.
 //
 type ConnectionMap struct {
+	sync.Mutex
 	netaddr     string
 	password    string
+	timeouts    RedisTimeouts
 	client      redis.Conn
 	connections map[int]redis.Conn
+	replicas    []string
+	useReplicas bool
+	cluster     *Cluster
+	shards      *ShardSet
+
+	// Requests take connections of their own from these, one pool per
+	// database; see Get.
+	//
+	poolSize int
+	pools    map[int]*redis.Pool
 }
 
 // Creates (and returns) a pointer to a ConnectionMap.
 //
-func NewConnectionMap(netaddr, password string) (cm *ConnectionMap) {
-	cm = &ConnectionMap{netaddr: netaddr, password: password}
+func NewConnectionMap(netaddr, password string, timeouts RedisTimeouts) (cm *ConnectionMap) {
+	cm = &ConnectionMap{netaddr: netaddr, password: password, timeouts: timeouts, poolSize: DefaultPoolSize}
+	return
+}
+
+// Creates the ConnectionMap for the Redis host described by a RedisBlock, and
+// populates its connections. If Sentinels are configured, the current master
+// is looked up through them, and followed when it fails over.
+//
+func NewUpstream(block RedisBlock) (cm *ConnectionMap, err error) {
+	if len(block.Shards) > 0 {
+		cm = NewConnectionMap("", block.Password, block.Timeouts())
+		cm.shards, err = NewShardSet(block.Shards, block.Timeouts())
+		return
+	}
+
+	if block.Cluster {
+		seeds := block.ClusterNodes
+		if len(seeds) == 0 {
+			seeds = []string{block.ConnectAddr()}
+		}
+		cm = NewConnectionMap(seeds[0], block.Password, block.Timeouts())
+		if cm.cluster, err = NewCluster(seeds, block.Password, block.Timeouts()); err != nil {
+			return
+		}
+		println("Found", len(cm.cluster.Nodes()), "cluster masters")
+		go cm.cluster.Watch()
+		return
+	}
+
+	if len(block.Sentinels) == 0 {
+		cm = NewConnectionMap(block.ConnectAddr(), block.Password, block.Timeouts())
+		cm.poolSize = block.Pool()
+		cm.replicas = block.Replicas
+		if err = cm.readFromReplicas(); err != nil {
+			return
+		}
+		err = cm.PopulateConnections()
+		return
+	}
+
+	s := NewSentinel(block.Sentinels, block.MasterName, block.Timeouts())
+	master, err := s.MasterAddr()
+	if err != nil {
+		return
+	}
+	replicas, _ := s.ReplicaAddrs()
+	println("Sentinel says master", block.MasterName, "is at", master)
+
+	cm = NewConnectionMap(master, block.Password, block.Timeouts())
+	cm.poolSize = block.Pool()
+	cm.replicas = replicas
+	if err = cm.readFromReplicas(); err != nil {
+		return
+	}
+	if err = cm.PopulateConnections(); err != nil {
+		return
+	}
+	go s.Watch(cm)
+	return
+}
+
+// In read-only mode, with readOnly.replicasOnly set, connects the
+// ConnectionMap to the replicas instead of the master.
+//
+func (c *ConnectionMap) readFromReplicas() (err error) {
+	if !config.ReadOnly.ReplicasOnly {
+		return
+	}
+	if len(c.replicas) == 0 {
+		err = fmt.Errorf("No replicas known for %s", c.netaddr)
+		return
+	}
+	c.useReplicas = true
 	return
 }
 
@@ -80,6 +177,16 @@ func NewConnectionMap(netaddr, password string) (cm *ConnectionMap) {
 // established.
 //
 func (c *ConnectionMap) NConnections() (dbs []int) {
+	if c.cluster != nil {
+		dbs = []int{0}
+		return
+	}
+	if c.shards != nil {
+		dbs = c.shards.Databases()
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
 	for k, _ := range c.connections {
 		dbs = append(dbs, k)
 	}
@@ -90,6 +197,8 @@ func (c *ConnectionMap) NConnections() (dbs []int) {
 // kept around for future use.
 //
 func (c *ConnectionMap) Add(db int, rc redis.Conn) {
+	c.Lock()
+	defer c.Unlock()
 	c.connections[db] = rc
 	return
 }
@@ -99,13 +208,34 @@ func (c *ConnectionMap) Add(db int, rc redis.Conn) {
 // it, and return it.
 //
 func (c *ConnectionMap) DB(db int) (r redis.Conn, err error) {
+	if c.cluster != nil {
+		if db != 0 {
+			err = errors.New("Redis Cluster only supports database 0")
+			return
+		}
+		r = c.cluster.Conn()
+		return
+	}
+	if c.shards != nil {
+		r = c.shards.Conn(db)
+		return
+	}
+
+	c.Lock()
 	client, existsp := c.connections[db]
-	if existsp {
+	c.Unlock()
+	if existsp && client.Err() == nil {
 		// Yay, we already have a client established to that database!
 		//
 		r = client
 		return
 	}
+	if existsp {
+		// The connection is broken (after a timeout, say), and would stay
+		// that way; connect again, below.
+		//
+		println("Reconnecting to DB #", db, "after:", client.Err().Error())
+	}
 
 	// Urg, it looks like this is the first time anything has been requested
 	// regarding this database. Let's establish a new connection to it, and
@@ -116,12 +246,188 @@ func (c *ConnectionMap) DB(db int) (r redis.Conn, err error) {
 	if *debug {
 		println("DEBUG", "Creating new Redis connection to DB #", db)
 	}
-	r, e := ConnectToRedisHost(c.netaddr, c.password, db)
+	r, e := c.Dial(db)
 	if e != nil {
 		err = e
 		return
 	}
-	c.Add(db, r)
+
+	// Someone else may have beaten us to it while we were connecting.
+	//
+	c.Lock()
+	defer c.Unlock()
+	if current, existsp := c.connections[db]; existsp && current != client && current.Err() == nil {
+		r.Close()
+		r = current
+		return
+	}
+	c.connections[db] = r
+	return
+}
+
+// Returns a connection to a database from its pool, for the caller's use
+// alone; closing it puts it back in the pool. When all of the pool's
+// connections are in use, this waits for one to be put back.
+//
+// Cluster and sharded upstreams have no pools: they route over their shared
+// connections to each node, and closing the client returned is harmless.
+//
+func (c *ConnectionMap) Get(db int) (r redis.Conn, err error) {
+	if c.cluster != nil || c.shards != nil {
+		r, err = c.DB(db)
+		return
+	}
+
+	c.Lock()
+	if c.pools == nil {
+		c.pools = make(map[int]*redis.Pool)
+	}
+	pool, ok := c.pools[db]
+	if !ok {
+		pool = &redis.Pool{
+			MaxIdle:     c.poolSize,
+			MaxActive:   c.poolSize,
+			IdleTimeout: PoolIdleTimeout,
+			Wait:        true,
+			Dial: func() (redis.Conn, error) {
+				return c.Dial(db)
+			},
+		}
+		c.pools[db] = pool
+	}
+	c.Unlock()
+
+	r = pool.Get()
+	if err = r.Err(); err != nil {
+		r.Close()
+		r = nil
+	}
+	return
+}
+
+// Opens a new connection to a database. Unlike the clients returned by DB,
+// the connection is not shared, and the caller is responsible for closing it.
+//
+func (c *ConnectionMap) Dial(db int) (r redis.Conn, err error) {
+	if c.cluster != nil {
+		if db != 0 {
+			err = errors.New("Redis Cluster only supports database 0")
+			return
+		}
+		r = c.cluster.DedicatedConn(0)
+		return
+	}
+	if c.shards != nil {
+		r = c.shards.DedicatedConn(db, 0)
+		return
+	}
+
+	r, err = ConnectToRedisHost(c.dialAddr(db), c.password, db, c.timeouts)
+	return
+}
+
+// Returns the address to connect to for a database: the master's, or when
+// reading from replicas, one of theirs.
+//
+func (c *ConnectionMap) dialAddr(db int) (addr string) {
+	c.Lock()
+	defer c.Unlock()
+	addr = c.netaddr
+	if c.useReplicas && len(c.replicas) > 0 {
+		// Spread the databases over the replicas.
+		//
+		addr = c.replicas[db%len(c.replicas)]
+	}
+	return
+}
+
+// Like Dial, but with the read timeout extended by wait, for connections that
+// will be used for blocking commands. A connection with no read timeout keeps
+// having none. On cluster and sharded upstreams, every node the connection
+// opens gets the extended timeout.
+//
+func (c *ConnectionMap) DialBlocking(db int, wait time.Duration) (r redis.Conn, err error) {
+	if wait <= 0 {
+		r, err = c.Dial(db)
+		return
+	}
+	if c.cluster != nil {
+		if db != 0 {
+			err = errors.New("Redis Cluster only supports database 0")
+			return
+		}
+		r = c.cluster.DedicatedConn(wait)
+		return
+	}
+	if c.shards != nil {
+		r = c.shards.DedicatedConn(db, wait)
+		return
+	}
+	r, err = ConnectToRedisHost(c.dialAddr(db), c.password, db, c.timeouts.Blocking(wait))
+	return
+}
+
+// Like Dial, but always connects to the master, even when the ConnectionMap
+// reads from replicas.
+//
+func (c *ConnectionMap) DialMaster(db int) (r redis.Conn, err error) {
+	if c.cluster != nil || c.shards != nil {
+		r, err = c.Dial(db)
+		return
+	}
+	c.Lock()
+	addr := c.netaddr
+	c.Unlock()
+	r, err = ConnectToRedisHost(addr, c.password, db, c.timeouts)
+	return
+}
+
+// Opens a connection to the master for Pub/Sub subscriptions, which are
+// quiet for as long as nothing is published, so it has no read timeout.
+//
+func (c *ConnectionMap) DialSubscriber() (r redis.Conn, err error) {
+	c.Lock()
+	addr := c.netaddr
+	c.Unlock()
+	t := c.timeouts
+	t.Read = 0
+	r, err = ConnectToRedisHost(addr, c.password, 0, t)
+	return
+}
+
+// Returns the address of the Redis host the ConnectionMap is connected to.
+//
+func (c *ConnectionMap) Addr() (addr string) {
+	c.Lock()
+	defer c.Unlock()
+	addr = c.netaddr
+	return
+}
+
+// Returns the addresses of the replicas of the Redis host, if they are known.
+//
+func (c *ConnectionMap) Replicas() (addrs []string) {
+	c.Lock()
+	defer c.Unlock()
+	addrs = append(addrs, c.replicas...)
+	return
+}
+
+// Points the ConnectionMap at a different Redis host (say, after a failover),
+// and re-establishes all of its connections. The old connections are closed,
+// and the pools emptied.
+//
+func (c *ConnectionMap) Rebuild(netaddr string, replicas []string) (err error) {
+	c.Lock()
+	c.netaddr = netaddr
+	c.replicas = replicas
+	pools := c.pools
+	c.pools = nil
+	c.Unlock()
+	for _, pool := range pools {
+		pool.Close()
+	}
+	err = c.PopulateConnections()
 	return
 }
 
@@ -129,11 +435,12 @@ func (c *ConnectionMap) DB(db int) (r redis.Conn, err error) {
 // was initialized with, that holds data.
 //
 func (cm *ConnectionMap) PopulateConnections() (err error) {
-	client, e := ConnectToRedisHost(cm.netaddr, cm.password, 0)
+	client, e := cm.Dial(0)
 	if e != nil {
 		err = e
 		return
 	}
+	defer client.Close()
 
 	info, e := GetHostInfo(client)
 	if e != nil {
@@ -149,16 +456,23 @@ func (cm *ConnectionMap) PopulateConnections() (err error) {
 				continue
 			}
 			println("Found", matches[0], matches[1])
-			conn, e := ConnectToRedisHost(cm.netaddr, cm.password, matches[1])
+			dbnum, _ := strconv.Atoi(matches[1])
+			conn, e := cm.Dial(dbnum)
 			if e != nil {
 				err = e
 				return
 			}
-			dbnum, _ := strconv.Atoi(matches[1])
 			conns[dbnum] = conn
 		}
 	}
+
+	cm.Lock()
+	old := cm.connections
 	cm.connections = conns
+	cm.Unlock()
+	for _, conn := range old {
+		conn.Close()
+	}
 	return
 }
 
@@ -0,0 +1,306 @@
+// routed.go
+//
+// A Redis client that spreads its commands over several nodes, sending each
+// one to the node that holds its key. It is used for both Redis Cluster and
+// client-side sharding.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errRoutedPipeline = errors.New("Pipelining is not supported when keys are spread over several nodes")
+
+// A router knows which node holds a key, and how to connect to the nodes.
+//
+type router interface {
+	// Returns the node holding a key.
+	//
+	NodeFor(key string) string
+
+	// Returns every node.
+	//
+	Nodes() []string
+
+	// Returns the shared connection to a node.
+	//
+	node(name string) (redis.Conn, error)
+
+	// Opens a new connection to a node, with its read timeout extended by
+	// wait.
+	//
+	dial(name string, wait time.Duration) (redis.Conn, error)
+}
+
+// A routedConn looks like a single Redis connection to the handlers, but
+// sends every command to the node that holds its key. Commands with several
+// keys must have all of them on the same node.
+//
+// Transactions are pinned to a node: WATCH pins to the watched key's node,
+// and a MULTI is held back until the first command with a key, which decides
+// where it goes.
+//
+type routedConn struct {
+	router router
+	own    map[string]redis.Conn
+	wait   time.Duration
+	pinned string
+	multi  bool
+}
+
+func (c *routedConn) conn(addr string) (conn redis.Conn, err error) {
+	if c.own == nil {
+		conn, err = c.router.node(addr)
+		return
+	}
+	conn, ok := c.own[addr]
+	if ok {
+		return
+	}
+	if conn, err = c.router.dial(addr, c.wait); err == nil {
+		c.own[addr] = conn
+	}
+	return
+}
+
+func (c *routedConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	switch strings.ToUpper(cmd) {
+	case "KEYS":
+		reply, err = c.keys(args...)
+		return
+
+	case "SCAN":
+		reply, err = c.scan(args...)
+		return
+
+	case "DBSIZE":
+		var total int64
+		reply, err = c.fanout(cmd, args, func(r interface{}) error {
+			n, e := redis.Int64(r, nil)
+			total += n
+			return e
+		})
+		reply = total
+		return
+
+	case "FLUSHDB":
+		reply, err = c.fanout(cmd, args, func(interface{}) error { return nil })
+		return
+
+	case "MULTI":
+		c.multi = true
+		if len(c.pinned) == 0 {
+			reply = "OK"
+			return
+		}
+
+	case "EXEC", "DISCARD":
+		defer func() { c.pinned, c.multi = "", false }()
+		if len(c.pinned) == 0 {
+			// Nothing was ever queued.
+			//
+			reply = []interface{}{}
+			return
+		}
+
+	case "UNWATCH":
+		if !c.multi {
+			defer func() { c.pinned = "" }()
+		}
+	}
+
+	addr := c.pinned
+	if len(addr) == 0 {
+		if key, ok := FirstKey(cmd, args); ok {
+			addr = c.router.NodeFor(key)
+			if err = c.sameNode(addr, cmd, args); err != nil {
+				return
+			}
+			if c.multi || strings.ToUpper(cmd) == "WATCH" {
+				c.pinned = addr
+				if c.multi {
+					var conn redis.Conn
+					if conn, err = c.conn(addr); err != nil {
+						return
+					}
+					if _, err = conn.Do("MULTI"); err != nil {
+						return
+					}
+				}
+			}
+		} else if nodes := c.router.Nodes(); len(nodes) > 0 {
+			addr = nodes[0]
+		}
+	}
+	if len(addr) == 0 {
+		err = errors.New("No node available")
+		return
+	}
+
+	asking := false
+	for i := 0; i < ClusterMaxRedirects; i++ {
+		var conn redis.Conn
+		if conn, err = c.conn(addr); err != nil {
+			return
+		}
+		if asking {
+			if _, err = conn.Do("ASKING"); err != nil {
+				return
+			}
+		}
+		reply, err = conn.Do(cmd, args...)
+
+		// Only Redis Cluster redirects, and never in the middle of a
+		// transaction.
+		//
+		// MOVED <slot> <addr> means the slot has a new owner for good;
+		// ASK <slot> <addr> means it is being migrated, and just this
+		// command should be retried on the other node.
+		//
+		redirect, ok := err.(redis.Error)
+		cluster, isCluster := c.router.(*Cluster)
+		if !ok || !isCluster || len(c.pinned) > 0 {
+			return
+		}
+		fields := strings.Fields(string(redirect))
+		if len(fields) != 3 {
+			return
+		}
+		switch fields[0] {
+		case "MOVED":
+			addr, asking = fields[2], false
+			go cluster.Refresh()
+		case "ASK":
+			addr, asking = fields[2], true
+		default:
+			return
+		}
+	}
+	err = fmt.Errorf("Too many cluster redirects for %s", cmd)
+	return
+}
+
+// Makes sure every key a command touches is held by the same node.
+//
+func (c *routedConn) sameNode(addr, cmd string, args []interface{}) (err error) {
+	for _, i := range CommandKeys(cmd, args) {
+		if c.router.NodeFor(argString(args[i])) != addr {
+			err = fmt.Errorf("The keys for %s are spread over several nodes; use hash tags to keep them together", cmd)
+			return
+		}
+	}
+	return
+}
+
+// Runs a command on every node, handing each reply to f.
+//
+func (c *routedConn) fanout(cmd string, args []interface{}, f func(interface{}) error) (reply interface{}, err error) {
+	for _, addr := range c.router.Nodes() {
+		var conn redis.Conn
+		if conn, err = c.conn(addr); err != nil {
+			return
+		}
+		var r interface{}
+		if r, err = conn.Do(cmd, args...); err != nil {
+			return
+		}
+		if err = f(r); err != nil {
+			return
+		}
+		reply = r
+	}
+	return
+}
+
+// Runs KEYS on every node, and returns all of the keys together.
+//
+func (c *routedConn) keys(args ...interface{}) (reply interface{}, err error) {
+	var keys []interface{}
+	_, err = c.fanout("KEYS", args, func(r interface{}) error {
+		v, e := redis.Values(r, nil)
+		keys = append(keys, v...)
+		return e
+	})
+	reply = keys
+	return
+}
+
+// Runs SCAN across every node in turn. The cursor handed back to the
+// caller is "<node>:<cursor>", so the next call knows where to pick up;
+// "0" still means the scan is done.
+//
+func (c *routedConn) scan(args ...interface{}) (reply interface{}, err error) {
+	if len(args) == 0 {
+		err = errors.New("SCAN needs a cursor")
+		return
+	}
+	nodes := c.router.Nodes()
+	index, cursor := 0, "0"
+	if s := argString(args[0]); s != "0" {
+		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 {
+			err = fmt.Errorf("Invalid SCAN cursor: %s", s)
+			return
+		}
+		if index, err = strconv.Atoi(parts[0]); err != nil {
+			return
+		}
+		cursor = parts[1]
+	}
+	if index >= len(nodes) {
+		reply = []interface{}{[]byte("0"), []interface{}{}}
+		return
+	}
+
+	conn, err := c.conn(nodes[index])
+	if err != nil {
+		return
+	}
+	r, err := redis.Values(conn.Do("SCAN", append([]interface{}{cursor}, args[1:]...)...))
+	if err != nil {
+		return
+	}
+	if len(r) != 2 {
+		err = errors.New("Unexpected reply to SCAN")
+		return
+	}
+	next, _ := redis.String(r[0], nil)
+	if next == "0" {
+		index++
+	}
+	if next != "0" || index < len(nodes) {
+		next = fmt.Sprintf("%d:%s", index, next)
+	}
+	reply = []interface{}{[]byte(next), r[1]}
+	return
+}
+
+func (c *routedConn) Close() (err error) {
+	for addr, conn := range c.own {
+		conn.Close()
+		delete(c.own, addr)
+	}
+	return
+}
+
+func (c *routedConn) Err() error {
+	return nil
+}
+
+func (c *routedConn) Send(cmd string, args ...interface{}) error {
+	return errRoutedPipeline
+}
+
+func (c *routedConn) Flush() error {
+	return errRoutedPipeline
+}
+
+func (c *routedConn) Receive() (interface{}, error) {
+	return nil, errRoutedPipeline
+}
@@ -0,0 +1,438 @@
+// schedule.go
+//
+// Scheduled writes. Any request that writes can be put off until a later
+// time with "at" (a timestamp) or "delay" (a duration): instead of running
+// it, Scarlet stores it, and a scheduler goroutine replays it when it is
+// due. Every instance of Scarlet runs a scheduler, and they share the
+// schedule, which is kept in Redis:
+//
+//	scarlet:{schedule}          sorted set of scheduled request ids, by due time
+//	scarlet:{schedule}:running  sorted set of claimed request ids, by lease expiry
+//	scarlet:{schedule}:jobs     hash of id -> the request (JSON)
+//	scarlet:{schedule}:seq      id counter
+//
+// A due request is claimed by moving it from the schedule to the running
+// set, in a single script, so only one instance runs it. It is deleted once
+// it has run. If the instance dies first, the lease runs out, and the next
+// claim puts the request back on the schedule, to be run again.
+//
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultScheduleInterval = time.Second
+	DefaultScheduleLease    = 10 * time.Minute
+
+	// How many due requests a scheduler claims at a time.
+	//
+	ScheduleBatchSize = 100
+
+	ScheduleKey        = "scarlet:{schedule}"
+	ScheduleRunningKey = "scarlet:{schedule}:running"
+	ScheduleJobsKey    = "scarlet:{schedule}:jobs"
+	ScheduleSeqKey     = "scarlet:{schedule}:seq"
+)
+
+// The layouts "at" may be given in, besides a Unix timestamp.
+//
+var scheduleLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04Z07:00"}
+
+// A request, as it was received, to be replayed later.
+//
+type ScheduledRequest struct {
+	Id          string     `json:"id"`
+	At          time.Time  `json:"at"`
+	Method      string     `json:"method"`
+	Path        string     `json:"path"`
+	Form        url.Values `json:"form"`
+	ContentType string     `json:"contentType,omitempty"`
+	Body        []byte     `json:"body,omitempty"`
+	Tenant      string     `json:"tenant,omitempty"`
+}
+
+// Puts a request on the schedule (or back on it, if it was claimed).
+//
+// KEYS: schedule, running, jobs
+// ARGV: id, due time (ms), request
+//
+var addScheduleScript = redis.NewScript(3, `
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[3], ARGV[1], ARGV[3])
+return 1
+`)
+
+// Puts the claimed requests whose lease has run out back on the schedule,
+// then claims the requests that are due, leasing them until now + lease,
+// and returns them.
+//
+// KEYS: schedule, running, jobs
+// ARGV: now (ms), how many to claim, lease (ms)
+//
+var claimScheduleScript = redis.NewScript(3, `
+local now = tonumber(ARGV[1])
+local limit = tonumber(ARGV[2])
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', now, 'LIMIT', 0, limit)) do
+  redis.call('ZREM', KEYS[2], id)
+  redis.call('ZADD', KEYS[1], now, id)
+end
+local jobs = {}
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', now, 'LIMIT', 0, limit)) do
+  redis.call('ZREM', KEYS[1], id)
+  local job = redis.call('HGET', KEYS[3], id)
+  if job then
+    redis.call('ZADD', KEYS[2], now + tonumber(ARGV[3]), id)
+    table.insert(jobs, job)
+  end
+end
+return jobs
+`)
+
+// Removes a request that has run (or was cancelled) for good.
+//
+// KEYS: schedule, running, jobs
+// ARGV: id
+//
+var removeScheduledScript = redis.NewScript(3, `
+redis.call('ZREM', KEYS[2], ARGV[1])
+redis.call('HDEL', KEYS[3], ARGV[1])
+return redis.call('ZREM', KEYS[1], ARGV[1])
+`)
+
+// Returns true if the request asks to be run later.
+//
+func IsScheduled(req *http.Request) bool {
+	return len(req.FormValue("at")) > 0 || len(req.FormValue("delay")) > 0
+}
+
+// Returns when a scheduled request should run, from its "at" or "delay"
+// parameter.
+//
+func scheduleTime(req *http.Request) (at time.Time, response R) {
+	if v := req.FormValue("at"); len(v) > 0 {
+		for _, layout := range scheduleLayouts {
+			if t, err := time.Parse(layout, v); err == nil {
+				at = t
+				return
+			}
+		}
+		if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+			at = time.Unix(secs, 0)
+			return
+		}
+		e := fmt.Sprintf("Invalid time for \"at\": %q", v)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	delay, response := durationParam(req, "delay", 0)
+	at = time.Now().Add(delay)
+	return
+}
+
+// Stores a write request to be run at the time it asks for, and responds
+// with a 202 and the request's id.
+//
+func ScheduleRequest(req *http.Request, info *RequestInfo) (response R) {
+	if !IsWrite(req, info) {
+		e := "Only requests that write can be scheduled."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	at, response := scheduleTime(req)
+	if response != nil {
+		return
+	}
+
+	job := ScheduledRequest{
+		At:          at.UTC(),
+		Method:      req.Method,
+		Path:        req.URL.EscapedPath(),
+		Form:        url.Values{},
+		ContentType: req.Header.Get("Content-Type"),
+	}
+	for name, values := range req.Form {
+		if name != "at" && name != "delay" {
+			job.Form[name] = values
+		}
+	}
+	if ct, _, _ := mime.ParseMediaType(job.ContentType); ct != "application/x-www-form-urlencoded" {
+		var err error
+		if job.Body, err = ioutil.ReadAll(req.Body); err != nil {
+			response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+	if info.Tenant != nil {
+		job.Tenant = info.Tenant.Name
+	}
+
+	conn, err := Database.Get(config.Schedule.Database)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	defer conn.Close()
+	job.Id, err = redis.String(conn.Do("INCR", ScheduleSeqKey))
+	if err == nil {
+		err = addSchedule(conn, job)
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	println("SCHEDULE", job.Id, job.Method, job.Path, job.At.Format(time.RFC3339))
+	result := R{"id": job.Id, "at": job.At.Format(time.RFC3339Nano)}
+	response = R{"result": result, "error": nil}.WithStatus(http.StatusAccepted)
+	return
+}
+
+func addSchedule(conn redis.Conn, job ScheduledRequest) (err error) {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return
+	}
+	at := job.At.UnixNano() / int64(time.Millisecond)
+	_, err = addScheduleScript.Do(conn, ScheduleKey, ScheduleRunningKey, ScheduleJobsKey, job.Id, at, b)
+	return
+}
+
+// Every Interval, claims the scheduled requests that are due, and runs them.
+// The scheduler pauses while the schedule's database is read-only. It has a
+// connection of its own, opened again if it breaks. This never returns; run
+// it in its own goroutine.
+//
+func RunScheduler(cm *ConnectionMap) {
+	interval, _ := parseDuration(config.Schedule.Interval, DefaultScheduleInterval)
+	lease, _ := parseDuration(config.Schedule.Lease, DefaultScheduleLease)
+	var conn redis.Conn
+	for {
+		time.Sleep(interval)
+		if ReadOnly.Is(strconv.Itoa(config.Schedule.Database)) {
+			continue
+		}
+		var err error
+		if conn != nil && conn.Err() != nil {
+			conn.Close()
+			conn = nil
+		}
+		if conn == nil {
+			if conn, err = cm.Dial(config.Schedule.Database); err != nil {
+				conn = nil
+			}
+		}
+		var jobs []string
+		if err == nil {
+			now := time.Now().UnixNano() / int64(time.Millisecond)
+			keys := []interface{}{ScheduleKey, ScheduleRunningKey, ScheduleJobsKey}
+			args := append(keys, now, ScheduleBatchSize, int64(lease/time.Millisecond))
+			jobs, err = redis.Strings(claimScheduleScript.Do(conn, args...))
+		}
+		if err != nil {
+			println("SCHEDULE", "error:", err.Error())
+			continue
+		}
+		for _, j := range jobs {
+			var job ScheduledRequest
+			if err = json.Unmarshal([]byte(j), &job); err != nil {
+				println("SCHEDULE", "error:", err.Error())
+				continue
+			}
+			runScheduled(conn, job, interval)
+		}
+	}
+}
+
+// Replays a scheduled request, as though it had just been received, and
+// takes it off the schedule. If its database has since been made read-only,
+// it is put back on the schedule, to be tried again after retry.
+//
+func runScheduled(conn redis.Conn, job ScheduledRequest, retry time.Duration) {
+	requeued := false
+	defer func() {
+		if requeued {
+			return
+		}
+		if _, err := removeScheduledScript.Do(conn, ScheduleKey, ScheduleRunningKey, ScheduleJobsKey, job.Id); err != nil {
+			println("SCHEDULE", job.Id, "error:", err.Error())
+		}
+	}()
+
+	timeout, _ := config.HTTP.RequestTimeouts()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(job.Method, job.Path+"?"+job.Form.Encode(), bytes.NewReader(job.Body))
+	if err != nil {
+		println("SCHEDULE", job.Id, "error:", err.Error())
+		return
+	}
+	req = req.WithContext(ctx)
+	if len(job.ContentType) > 0 {
+		req.Header.Set("Content-Type", job.ContentType)
+	}
+	info, err := GetRequestInfo(req)
+	if err != nil {
+		println("SCHEDULE", job.Id, "error:", err.Error())
+		return
+	}
+	if len(job.Tenant) > 0 {
+		for i := range config.Tenants {
+			if config.Tenants[i].Name == job.Tenant {
+				info.Tenant = &config.Tenants[i]
+			}
+		}
+		if info.Tenant == nil {
+			println("SCHEDULE", job.Id, "error: unknown tenant", job.Tenant)
+			return
+		}
+	}
+
+	if _, denied := CheckReadOnly(req, info); denied {
+		// If this fails, the request stays claimed, and goes back on the
+		// schedule once its lease runs out.
+		//
+		requeued = true
+		job.At = time.Now().Add(retry).UTC()
+		if err = addSchedule(conn, job); err != nil {
+			println("SCHEDULE", job.Id, "error:", err.Error())
+		}
+		return
+	}
+	response := RunWithDeadline(req, true, func() R {
+		defer info.Close()
+		return HandleRequest(req, info)
+	})
+	println("SCHEDULE", "ran", job.Id, job.Method, job.Path, response.Status())
+	if e, ok := response["error"].(string); ok {
+		println("SCHEDULE", job.Id, "error:", e)
+	}
+	return
+}
+
+// Handles /_schedule/:
+//
+//	GET    /_schedule/      the requests waiting to run
+//	DELETE /_schedule/{id}  cancel a request
+//
+// Tenants only see, and cancel, their own requests.
+//
+func ScheduleHandler(rw http.ResponseWriter, req *http.Request) {
+	if !config.Schedule.Enabled {
+		http.NotFound(rw, req)
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/_schedule/")
+	info := &RequestInfo{DbNum: config.Schedule.Database, Tenant: TenantFor(req), ctx: req.Context()}
+	defer info.Close()
+	if response, denied := CheckRequest(rw, req, info); denied {
+		WriteResponse(rw, req, response)
+		return
+	}
+
+	var response R
+	switch {
+	case req.Method == "GET" && len(id) == 0:
+		response = ListSchedule(info)
+	case req.Method == "DELETE" && len(id) > 0:
+		response = CancelScheduled(info, id)
+	default:
+		e := "Not found."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+	}
+	WriteResponse(rw, req, response)
+	return
+}
+
+// Returns the scheduled request with the given id, if it belongs to the
+// requester's tenant.
+//
+func scheduledRequest(conn redis.Conn, info *RequestInfo, id string) (job *ScheduledRequest, err error) {
+	b, err := redis.Bytes(conn.Do("HGET", ScheduleJobsKey, id))
+	if err != nil {
+		return
+	}
+	var j ScheduledRequest
+	if err = json.Unmarshal(b, &j); err != nil {
+		return
+	}
+	tenant := ""
+	if info.Tenant != nil {
+		tenant = info.Tenant.Name
+	}
+	if j.Tenant == tenant {
+		job = &j
+	}
+	return
+}
+
+// Lists the requests waiting to run, soonest first (up to the first 1000),
+// without their bodies.
+//
+func ListSchedule(info *RequestInfo) (response R) {
+	conn, err := Database.Get(config.Schedule.Database)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	defer conn.Close()
+	ids, err := redis.Strings(conn.Do("ZRANGE", ScheduleKey, 0, 999))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	jobs := []R{}
+	for _, id := range ids {
+		job, err := scheduledRequest(conn, info, id)
+		if err != nil || job == nil {
+			continue
+		}
+		jobs = append(jobs, R{
+			"id":     job.Id,
+			"at":     job.At.Format(time.RFC3339Nano),
+			"method": job.Method,
+			"path":   job.Path,
+		})
+	}
+	response = R{"result": jobs, "error": nil}
+	return
+}
+
+func CancelScheduled(info *RequestInfo, id string) (response R) {
+	conn, err := Database.Get(config.Schedule.Database)
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	defer conn.Close()
+	job, err := scheduledRequest(conn, info, id)
+	if err == redis.ErrNil || (err == nil && job == nil) {
+		e := fmt.Sprintf("No scheduled request %s.", id)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+		return
+	}
+	var n int
+	if err == nil {
+		n, err = redis.Int(removeScheduledScript.Do(conn, ScheduleKey, ScheduleRunningKey, ScheduleJobsKey, id))
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	println("SCHEDULE", "cancel", id)
+	response = R{"result": n == 1, "error": nil}
+	return
+}
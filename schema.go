@@ -0,0 +1,377 @@
+// schema.go
+//
+// Validation of JSON documents against the JSON Schema registered for the
+// keys they are stored under. A useful subset of JSON Schema is supported:
+// type, enum, const, properties, required, additionalProperties, items,
+// minItems/maxItems, minLength/maxLength, minimum/maximum and pattern.
+//
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type keySchema struct {
+	pattern *regexp.Regexp
+	schema  interface{}
+}
+
+// The schemas from the configuration, in order; the first one whose pattern
+// matches a key applies to it.
+//
+var Schemas []keySchema
+
+// The regular expressions of the schemas' "pattern" keywords, compiled when
+// the schemas are loaded.
+//
+var schemaPatterns = make(map[string]*regexp.Regexp)
+
+// Loads (and compiles the key patterns of) the schemas in the configuration.
+//
+func LoadSchemas(blocks []SchemaBlock) (err error) {
+	for _, b := range blocks {
+		data := []byte(b.Schema)
+		if len(b.File) > 0 {
+			if data, err = ioutil.ReadFile(b.File); err != nil {
+				return
+			}
+		}
+		var s keySchema
+		if err = json.Unmarshal(data, &s.schema); err != nil {
+			err = fmt.Errorf("Invalid schema for %s: %s", b.Pattern, err)
+			return
+		}
+		if s.pattern, err = globRegexp(b.Pattern); err != nil {
+			err = fmt.Errorf("Invalid key pattern %s: %s", b.Pattern, err)
+			return
+		}
+		if err = compilePatterns(s.schema); err != nil {
+			err = fmt.Errorf("Invalid schema for %s: %s", b.Pattern, err)
+			return
+		}
+		println("Loaded schema for", b.Pattern)
+		Schemas = append(Schemas, s)
+	}
+	return
+}
+
+// Compiles every "pattern" in a schema (and the schemas nested in it) into
+// schemaPatterns.
+//
+func compilePatterns(schema interface{}) (err error) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return
+	}
+	if p, ok := s["pattern"].(string); ok {
+		if schemaPatterns[p] == nil {
+			if schemaPatterns[p], err = regexp.Compile(p); err != nil {
+				delete(schemaPatterns, p)
+				err = fmt.Errorf("Invalid pattern %s: %s", p, err)
+				return
+			}
+		}
+	}
+	if props, ok := s["properties"].(map[string]interface{}); ok {
+		for _, ps := range props {
+			if err = compilePatterns(ps); err != nil {
+				return
+			}
+		}
+	}
+	for _, keyword := range []string{"items", "additionalProperties"} {
+		if err = compilePatterns(s[keyword]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// Turns a Redis-style glob pattern ("user:*", "h?llo", "[ab]*") into a
+// regular expression.
+//
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		case '[':
+			end := strings.IndexByte(glob[i:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			re.WriteString("[" + strings.Replace(class, `\-`, "-", -1) + "]")
+			i += end
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				re.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+	return regexp.Compile(re.String())
+}
+
+// Returns the schema registered for a key, if there is one.
+//
+func SchemaFor(key string) (schema interface{}, ok bool) {
+	for _, s := range Schemas {
+		if s.pattern.MatchString(key) {
+			return s.schema, true
+		}
+	}
+	return
+}
+
+// Checks a decoded document against the schema for its key. Returns a 422
+// response listing what is wrong, or nil if the document is valid (or there
+// is no schema for the key).
+//
+func ValidateDocument(key string, doc interface{}) (response R) {
+	schema, ok := SchemaFor(key)
+	if !ok {
+		return
+	}
+	var problems []string
+	validateSchema(schema, doc, "$", &problems)
+	if len(problems) > 0 {
+		e := "The document does not match the schema: " + strings.Join(problems, "; ")
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusUnprocessableEntity)
+	}
+	return
+}
+
+// Like ValidateDocument, for a value that has not been decoded yet.
+//
+func ValidateValue(key, value string) (response R) {
+	if _, ok := SchemaFor(key); !ok {
+		return
+	}
+	var doc interface{}
+	if err := decodeJSON(strings.NewReader(value), &doc); err != nil {
+		e := fmt.Sprintf("Values stored under %s must be JSON documents: %s", key, err)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusUnprocessableEntity)
+		return
+	}
+	response = ValidateDocument(key, doc)
+	return
+}
+
+func jsonType(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, json.Number:
+		if n, ok := jsonNumber(t); ok && n.IsInt() {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "unknown"
+}
+
+// Returns the exact value of a decoded JSON number, whether it was decoded
+// as a float64 (as schemas are) or a json.Number (as documents are).
+//
+func jsonNumber(v interface{}) (n *big.Rat, ok bool) {
+	switch t := v.(type) {
+	case float64:
+		if !math.IsInf(t, 0) && !math.IsNaN(t) {
+			n, ok = new(big.Rat).SetFloat64(t), true
+		}
+	case json.Number:
+		n, ok = new(big.Rat).SetString(string(t))
+	}
+	return
+}
+
+func hasType(v interface{}, want string) bool {
+	t := jsonType(v)
+	return t == want || (want == "number" && t == "integer")
+}
+
+// Checks v against a schema, adding a description of every problem found to
+// problems. at is where v is in the document, as a JSONPath.
+//
+func validateSchema(schema, v interface{}, at string, problems *[]string) {
+	fail := func(format string, args ...interface{}) {
+		*problems = append(*problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if b, ok := schema.(bool); ok {
+		if !b {
+			fail("no value is allowed here")
+		}
+		return
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	switch t := s["type"].(type) {
+	case string:
+		if !hasType(v, t) {
+			fail("expected %s, found %s", t, jsonType(v))
+			return
+		}
+	case []interface{}:
+		matched := false
+		var names []string
+		for _, name := range t {
+			n, _ := name.(string)
+			names = append(names, n)
+			matched = matched || hasType(v, n)
+		}
+		if !matched {
+			fail("expected one of %s, found %s", strings.Join(names, ", "), jsonType(v))
+			return
+		}
+	}
+
+	if enum, ok := s["enum"].([]interface{}); ok {
+		found := false
+		for _, e := range enum {
+			found = found || jsonEqual(e, v)
+		}
+		if !found {
+			fail("value is not one of the allowed values")
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, v) {
+		fail("value is not the required constant")
+	}
+
+	switch val := v.(type) {
+	case map[string]interface{}:
+		props, _ := s["properties"].(map[string]interface{})
+		if required, ok := s["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, _ := r.(string); len(name) > 0 {
+					if _, present := val[name]; !present {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		names := make([]string, 0, len(val))
+		for name := range val {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if ps, ok := props[name]; ok {
+				validateSchema(ps, val[name], at+"."+name, problems)
+			} else if extra, ok := s["additionalProperties"]; ok {
+				if b, isBool := extra.(bool); isBool && !b {
+					fail("unexpected property %q", name)
+				} else {
+					validateSchema(extra, val[name], at+"."+name, problems)
+				}
+			}
+		}
+
+	case []interface{}:
+		if items, ok := s["items"]; ok {
+			for i, item := range val {
+				validateSchema(items, item, fmt.Sprintf("%s[%d]", at, i), problems)
+			}
+		}
+		if min, ok := s["minItems"].(float64); ok && float64(len(val)) < min {
+			fail("expected at least %v items", min)
+		}
+		if max, ok := s["maxItems"].(float64); ok && float64(len(val)) > max {
+			fail("expected at most %v items", max)
+		}
+
+	case string:
+		n := float64(utf8.RuneCountInString(val))
+		if min, ok := s["minLength"].(float64); ok && n < min {
+			fail("expected at least %v characters", min)
+		}
+		if max, ok := s["maxLength"].(float64); ok && n > max {
+			fail("expected at most %v characters", max)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			if re := schemaPatterns[p]; re != nil && !re.MatchString(val) {
+				fail("does not match the pattern %s", p)
+			}
+		}
+
+	case float64, json.Number:
+		n, _ := jsonNumber(val)
+		if min, ok := jsonNumber(s["minimum"]); ok && n != nil && n.Cmp(min) < 0 {
+			fail("expected at least %v", s["minimum"])
+		}
+		if max, ok := jsonNumber(s["maximum"]); ok && n != nil && n.Cmp(max) > 0 {
+			fail("expected at most %v", s["maximum"])
+		}
+	}
+	return
+}
+
+// Reports whether two decoded JSON values are equal. Numbers are compared by
+// value, so 1, 1.0 and 1e0 are all the same.
+//
+func jsonEqual(a, b interface{}) bool {
+	if x, ok := jsonNumber(a); ok {
+		y, ok := jsonNumber(b)
+		return ok && x.Cmp(y) == 0
+	}
+	switch x := a.(type) {
+	case []interface{}:
+		y, ok := b.([]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !jsonEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for k, v := range x {
+			if w, present := y[k]; !present || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	}
+	return a == b
+}
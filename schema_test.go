@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestGlobRegexp(t *testing.T) {
+	tests := []struct {
+		glob    string
+		matches []string
+		misses  []string
+	}{
+		{"user:*", []string{"user:", "user:1", "user:1:name"}, []string{"user", "users:1", "xuser:1"}},
+		{"h?llo", []string{"hello", "hallo"}, []string{"hllo", "heello"}},
+		{"h[ae]llo", []string{"hello", "hallo"}, []string{"hillo", "h[ae]llo"}},
+		{"h[^e]llo", []string{"hallo", "hbllo"}, []string{"hello"}},
+		{"h[a-b]llo", []string{"hallo", "hbllo"}, []string{"hcllo"}},
+		{"a.b", []string{"a.b"}, []string{"axb"}},
+		{"a+(b)", []string{"a+(b)"}, []string{"aa(b)"}},
+		{`a\*b`, []string{"a*b"}, []string{"axb"}},
+		{"a[b", []string{"a[b"}, []string{"ab"}},
+		{"*", []string{"", "anything"}, nil},
+	}
+	for _, test := range tests {
+		re, err := globRegexp(test.glob)
+		if err != nil {
+			t.Errorf("globRegexp(%q) failed: %s", test.glob, err)
+			continue
+		}
+		for _, s := range test.matches {
+			if !re.MatchString(s) {
+				t.Errorf("%q does not match %q", test.glob, s)
+			}
+		}
+		for _, s := range test.misses {
+			if re.MatchString(s) {
+				t.Errorf("%q matches %q", test.glob, s)
+			}
+		}
+	}
+}
+
+func TestJSONType(t *testing.T) {
+	tests := []struct {
+		value string
+		t     string
+	}{
+		{`null`, "null"},
+		{`true`, "boolean"},
+		{`1`, "integer"},
+		{`1.0`, "integer"},
+		{`1e3`, "integer"},
+		{`12345678901234567891`, "integer"},
+		{`1.5`, "number"},
+		{`"1"`, "string"},
+		{`[]`, "array"},
+		{`{}`, "object"},
+	}
+	for _, test := range tests {
+		if jt := jsonType(decodeDocument(t, test.value)); jt != test.t {
+			t.Errorf("jsonType(%s) = %s, want %s", test.value, jt, test.t)
+		}
+	}
+}
+
+const testSchema = `{
+	"type": "object",
+	"required": ["id", "name"],
+	"additionalProperties": false,
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"count": {"type": "integer", "maximum": 10},
+		"name": {"type": "string", "minLength": 1, "maxLength": 5, "pattern": "^[a-z]+$"},
+		"score": {"type": ["number", "null"]},
+		"role": {"enum": ["admin", "user", 3]},
+		"version": {"const": 2},
+		"tags": {"type": "array", "items": {"type": "string"}, "minItems": 1, "maxItems": 2},
+		"extra": {"type": "object", "additionalProperties": {"type": "boolean"}}
+	}
+}`
+
+func TestValidateSchema(t *testing.T) {
+	var schema interface{}
+	if err := json.Unmarshal([]byte(testSchema), &schema); err != nil {
+		t.Fatal(err)
+	}
+	if err := compilePatterns(schema); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		doc      string
+		problems []string
+	}{
+		{`{"id": 1, "name": "ann"}`, nil},
+		{`{"id": 12345678901234567891, "name": "ann", "score": null, "role": 3.0, "version": 2.0,
+			"tags": ["a"], "extra": {"x": true}}`, nil},
+		{`{"id": 1.5, "name": "ann", "score": 0.5}`, []string{"$.id: expected integer, found number"}},
+		{`{"name": "ann"}`, []string{`$: missing required property "id"`}},
+		{`{"id": 0, "name": "ann"}`, []string{"$.id: expected at least 1"}},
+		{`{"id": 1, "name": "ann", "count": 10.0}`, nil},
+		{`{"id": 1, "name": "ann", "count": 11}`, []string{"$.count: expected at most 10"}},
+		{`{"id": 1, "name": ""}`, []string{"$.name: expected at least 1 characters", "$.name: does not match the pattern ^[a-z]+$"}},
+		{`{"id": 1, "name": "abcdef"}`, []string{"$.name: expected at most 5 characters"}},
+		{`{"id": 1, "name": "Ann"}`, []string{"$.name: does not match the pattern ^[a-z]+$"}},
+		{`{"id": 1, "name": "ann", "score": "high"}`, []string{"$.score: expected one of number, null, found string"}},
+		{`{"id": 1, "name": "ann", "role": "root"}`, []string{"$.role: value is not one of the allowed values"}},
+		{`{"id": 1, "name": "ann", "version": 3}`, []string{"$.version: value is not the required constant"}},
+		{`{"id": 1, "name": "ann", "tags": []}`, []string{"$.tags: expected at least 1 items"}},
+		{`{"id": 1, "name": "ann", "tags": ["a", 2, "c"]}`, []string{"$.tags[1]: expected string, found integer", "$.tags: expected at most 2 items"}},
+		{`{"id": 1, "name": "ann", "extra": {"x": 1}}`, []string{"$.extra.x: expected boolean, found integer"}},
+		{`{"id": 1, "name": "ann", "other": 1}`, []string{`$: unexpected property "other"`}},
+		{`[]`, []string{"$: expected object, found array"}},
+	}
+	for _, test := range tests {
+		var problems []string
+		validateSchema(schema, decodeDocument(t, test.doc), "$", &problems)
+		if strings.Join(problems, "\n") != strings.Join(test.problems, "\n") {
+			t.Errorf("validateSchema(%s) = %q, want %q", test.doc, problems, test.problems)
+		}
+	}
+
+	var problems []string
+	validateSchema(false, decodeDocument(t, `1`), "$", &problems)
+	if len(problems) != 1 {
+		t.Errorf("validateSchema(false) = %q, want one problem", problems)
+	}
+}
+
+func TestLoadSchemasRejectsInvalidPatterns(t *testing.T) {
+	defer func(s []keySchema) { Schemas = s }(Schemas)
+	blocks := []SchemaBlock{{
+		Pattern: "doc:*",
+		Schema:  json.RawMessage(`{"properties": {"a": {"items": {"pattern": "("}}}}`),
+	}}
+	if err := LoadSchemas(blocks); err == nil {
+		t.Errorf("LoadSchemas accepted an invalid pattern")
+	}
+}
@@ -0,0 +1,180 @@
+// sentinel.go
+//
+// Finds the current Redis master (and its replicas) through Redis Sentinel,
+// and follows it around when it fails over.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"strings"
+	"time"
+)
+
+// How long to wait before trying the Sentinels again, after losing the
+// connection to all of them.
+//
+const SentinelRetryInterval = 2 * time.Second
+
+type Sentinel struct {
+	addrs    []string
+	master   string
+	timeouts RedisTimeouts
+}
+
+func NewSentinel(addrs []string, master string, timeouts RedisTimeouts) (s *Sentinel) {
+	s = &Sentinel{addrs: addrs, master: master, timeouts: timeouts}
+	return
+}
+
+// Asks each Sentinel in turn for something, until one of them answers.
+//
+func (s *Sentinel) ask(f func(c redis.Conn) error) (err error) {
+	err = errors.New("No Sentinels configured")
+	for _, addr := range s.addrs {
+		var c redis.Conn
+		c, err = redis.DialTimeout("tcp", addr, s.timeouts.Connect, s.timeouts.Read, s.timeouts.Write)
+		if err != nil {
+			continue
+		}
+		err = f(c)
+		c.Close()
+		if err == nil {
+			return
+		}
+		println("SENTINEL", addr, "error:", err.Error())
+	}
+	return
+}
+
+// Returns the address of the current master.
+//
+func (s *Sentinel) MasterAddr() (addr string, err error) {
+	err = s.ask(func(c redis.Conn) (e error) {
+		hostport, e := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.master))
+		if e == redis.ErrNil {
+			e = fmt.Errorf("Sentinel does not know about master %q", s.master)
+		}
+		if e != nil {
+			return
+		}
+		if len(hostport) != 2 {
+			e = errors.New("Unexpected reply from Sentinel")
+			return
+		}
+		addr = net.JoinHostPort(hostport[0], hostport[1])
+		return
+	})
+	return
+}
+
+// Returns the addresses of the master's replicas that Sentinel believes are
+// up.
+//
+func (s *Sentinel) ReplicaAddrs() (addrs []string, err error) {
+	err = s.ask(func(c redis.Conn) (e error) {
+		replies, e := redis.Values(c.Do("SENTINEL", "slaves", s.master))
+		if e != nil {
+			return
+		}
+		addrs = nil
+		for _, reply := range replies {
+			fields, e := redis.StringMap(reply, nil)
+			if e != nil {
+				continue
+			}
+			flags := fields["flags"]
+			if strings.Contains(flags, "s_down") || strings.Contains(flags, "o_down") ||
+				strings.Contains(flags, "disconnected") {
+				continue
+			}
+			addrs = append(addrs, net.JoinHostPort(fields["ip"], fields["port"]))
+		}
+		return
+	})
+	return
+}
+
+// Keeps the ConnectionMap pointed at the current master. Sentinels announce
+// failovers on the "+switch-master" channel; whenever one is announced for
+// our master, the connections are rebuilt. Since announcements can be missed
+// while no Sentinel is reachable, the master is looked up again every time a
+// subscription is (re-)established.
+//
+// This never returns; run it in its own goroutine.
+//
+func (s *Sentinel) Watch(cm *ConnectionMap) {
+	for {
+		for _, addr := range s.addrs {
+			s.resync(cm)
+			if err := s.subscribe(addr, cm); err != nil {
+				println("SENTINEL", addr, "error:", err.Error())
+			}
+		}
+		time.Sleep(SentinelRetryInterval)
+	}
+}
+
+// Makes sure the ConnectionMap is pointed at the master Sentinel currently
+// knows about.
+//
+func (s *Sentinel) resync(cm *ConnectionMap) {
+	master, err := s.MasterAddr()
+	if err != nil {
+		println("SENTINEL", "could not resolve master:", err.Error())
+		return
+	}
+	replicas, _ := s.ReplicaAddrs()
+	if master != cm.Addr() {
+		s.failover(cm, master, replicas)
+	}
+	return
+}
+
+func (s *Sentinel) failover(cm *ConnectionMap, master string, replicas []string) {
+	println("SENTINEL", "master", s.master, "is now at", master)
+	if err := cm.Rebuild(master, replicas); err != nil {
+		println("SENTINEL", "could not connect to new master:", err.Error())
+	}
+	return
+}
+
+// Listens for "+switch-master" announcements from a single Sentinel, until
+// the connection to it fails.
+//
+func (s *Sentinel) subscribe(addr string, cm *ConnectionMap) (err error) {
+	// No read timeout here: the subscription is quiet until something
+	// fails over.
+	//
+	c, err := redis.DialTimeout("tcp", addr, s.timeouts.Connect, 0, s.timeouts.Write)
+	if err != nil {
+		return
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+	if err = psc.Subscribe("+switch-master"); err != nil {
+		return
+	}
+
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.Message:
+			// <master-name> <old-ip> <old-port> <new-ip> <new-port>
+			//
+			parts := strings.Fields(string(msg.Data))
+			if len(parts) != 5 || parts[0] != s.master {
+				continue
+			}
+			master := net.JoinHostPort(parts[3], parts[4])
+			replicas, _ := s.ReplicaAddrs()
+			s.failover(cm, master, replicas)
+
+		case error:
+			err = msg
+			return
+		}
+	}
+}
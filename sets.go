@@ -0,0 +1,295 @@
+// sets.go
+//
+// Set algebra: membership checks, cardinality, random members, and unions,
+// intersections and differences of sets (and sorted sets) across keys.
+//
+package main
+
+import (
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	Operations["ismember"] = Operation{Methods: []string{"GET"}, Handler: HandleIsMember}
+	Operations["card"] = Operation{Methods: []string{"GET"}, Handler: HandleCard}
+	Operations["random"] = Operation{Methods: []string{"GET"}, Handler: HandleRandomMember}
+	for _, op := range []string{"union", "inter", "diff"} {
+		Operations[op] = Operation{Methods: []string{"GET", "POST"}, Handler: HandleSetAlgebra}
+	}
+	return
+}
+
+// Handles GET /{db}/{key}/ismember?member={m}. With one member, the result
+// is true or false; with several, it maps each member to true or false.
+//
+func HandleIsMember(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	req.ParseForm()
+	members := req.Form["member"]
+	if len(members) == 0 {
+		e := "Missing required parameter: member."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	if len(members) == 1 {
+		println("SISMEMBER", info.Key, members[0])
+		ismember, err := redis.Bool(client.Do("SISMEMBER", info.Key, members[0]))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		response = R{"result": ismember, "error": nil}
+		return
+	}
+
+	println("SMISMEMBER", info.Key, strings.Join(members, " "))
+	flags, err := redis.Ints(client.Do("SMISMEMBER", redis.Args{}.Add(info.Key).AddFlat(members)...))
+	if unknownCommand(err) {
+		// Servers older than Redis 6.2 have to be asked one member at
+		// a time.
+		//
+		flags, err = make([]int, len(members)), nil
+		for i, m := range members {
+			if flags[i], err = redis.Int(client.Do("SISMEMBER", info.Key, m)); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	result := make(map[string]bool)
+	for i, m := range members {
+		result[m] = flags[i] == 1
+	}
+	response = R{"result": result, "error": nil}
+	return
+}
+
+// Handles GET /{db}/{key}/card, returning the number of members in a set.
+//
+func HandleCard(req *http.Request, info *RequestInfo) (response R) {
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	println("SCARD", info.Key)
+	n, err := redis.Int64(client.Do("SCARD", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
+
+// Returns the "count" parameter, and whether it was given at all.
+//
+func countParam(req *http.Request) (count int, given bool, response R) {
+	c := req.FormValue("count")
+	if len(c) == 0 {
+		return
+	}
+	count, err := strconv.Atoi(c)
+	if err != nil {
+		e := fmt.Sprintf("Invalid count: %s", c)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	given = true
+	return
+}
+
+// Handles GET /{db}/{key}/random, returning a random member of a set without
+// removing it. With "count", a list of up to that many distinct members is
+// returned; a negative count may return the same member more than once.
+//
+func HandleRandomMember(req *http.Request, info *RequestInfo) (response R) {
+	count, given, response := countParam(req)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	if given {
+		println("SRANDMEMBER", info.Key, count)
+		r, err := redis.Strings(client.Do("SRANDMEMBER", info.Key, count))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		response = R{"result": r, "error": nil}
+		return
+	}
+	println("SRANDMEMBER", info.Key)
+	response = popResult(client.Do("SRANDMEMBER", info.Key))
+	return
+}
+
+// Removes and returns a random member of a set, or, with "count", a list of
+// up to that many; this is what /{db}/{key}/pop does for sets.
+//
+func HandleSetPop(req *http.Request, info *RequestInfo) (response R) {
+	count, given, response := countParam(req)
+	if response != nil {
+		return
+	}
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	if given {
+		println("SPOP", info.Key, count)
+		r, err := redis.Strings(client.Do("SPOP", info.Key, count))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		response = R{"result": r, "error": nil}
+		return
+	}
+	println("SPOP", info.Key)
+	response = popResult(client.Do("SPOP", info.Key))
+	return
+}
+
+// Builds the response for a command that returns a single member, or nil
+// when the set is empty (or missing), which is a 404.
+//
+func popResult(reply interface{}, err error) (response R) {
+	member, err := redis.String(reply, err)
+	if err == redis.ErrNil {
+		e := "The set is empty."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": member, "error": nil}
+	return
+}
+
+// Handles /{db}/{key}/union, /inter and /diff, combining the key with the
+// keys given in "key" parameters.
+//
+// A GET returns the members of the result. A POST stores the result in the
+// key named by "store", and returns how many members it has; sorted sets can
+// only be combined this way (except by diff), optionally with a "weight" for
+// every key (the request's key first), and an "aggregate" of sum, min or max.
+//
+func HandleSetAlgebra(req *http.Request, info *RequestInfo) (response R) {
+	req.ParseForm()
+	keys := append([]string{info.Key}, req.Form["key"]...)
+	store := req.FormValue("store")
+	if len(keys) < 2 && info.Op != "diff" {
+		e := "Missing required parameter: key."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+	if (req.Method == "POST") != (len(store) > 0) {
+		e := "Use POST with a \"store\" parameter to store the result, or GET without one."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
+		return
+	}
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+
+	cmd := "S" + strings.ToUpper(info.Op)
+	if keytype == "zset" {
+		response = storeSortedSets(req, client, info.Op, store, keys)
+		return
+	}
+	if len(store) == 0 {
+		println(cmd, strings.Join(keys, " "))
+		r, err := redis.Strings(client.Do(cmd, redis.Args{}.AddFlat(keys)...))
+		if err != nil {
+			response = ErrorResponse(err)
+			return
+		}
+		response = R{"result": r, "error": nil}
+		return
+	}
+
+	println(cmd+"STORE", store, strings.Join(keys, " "))
+	n, err := redis.Int64(client.Do(cmd+"STORE", redis.Args{}.Add(store).AddFlat(keys)...))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
+
+// Stores the union or intersection of sorted sets with ZUNIONSTORE or
+// ZINTERSTORE.
+//
+func storeSortedSets(req *http.Request, client redis.Conn, op, store string, keys []string) (response R) {
+	if op == "diff" || len(store) == 0 {
+		e := "Sorted sets can only be combined by union or inter, with POST and \"store\"."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	args := redis.Args{}.Add(store, len(keys)).AddFlat(keys)
+	if weights := req.Form["weight"]; len(weights) > 0 {
+		if len(weights) != len(keys) {
+			e := fmt.Sprintf("Expected %d weights, one for every key.", len(keys))
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		args = args.Add("WEIGHTS")
+		for _, w := range weights {
+			f, err := strconv.ParseFloat(w, 64)
+			if err != nil {
+				e := fmt.Sprintf("Invalid weight: %s", w)
+				response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+				return
+			}
+			args = args.Add(f)
+		}
+	}
+	if aggregate := strings.ToUpper(req.FormValue("aggregate")); len(aggregate) > 0 {
+		if aggregate != "SUM" && aggregate != "MIN" && aggregate != "MAX" {
+			e := "The \"aggregate\" parameter must be one of sum, min or max."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+		args = args.Add("AGGREGATE", aggregate)
+	}
+
+	cmd := "Z" + strings.ToUpper(op) + "STORE"
+	println(cmd, store, strings.Join(keys, " "))
+	n, err := redis.Int64(client.Do(cmd, args...))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": n, "error": nil}
+	return
+}
@@ -0,0 +1,214 @@
+// shard.go
+//
+// Client-side sharding: several independent Redis servers, presented as one
+// keyspace. Keys are placed on the servers with consistent hashing, so
+// adding a server only moves the keys that now belong to it.
+//
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"hash/crc32"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How many points each shard gets on the hash ring. More points spread the
+// keys more evenly.
+//
+const ShardVirtualNodes = 160
+
+type ringPoint struct {
+	hash  uint32
+	shard string
+}
+
+// A ShardSet holds a ConnectionMap for every shard, and the hash ring used to
+// decide which shard a key lives on. The ring is built from the shard names,
+// not their addresses, so a shard can be moved without moving its keys.
+//
+type ShardSet struct {
+	names []string
+	ring  []ringPoint
+	maps  map[string]*ConnectionMap
+}
+
+// Connects to every shard.
+//
+func NewShardSet(blocks []ShardBlock, timeouts RedisTimeouts) (s *ShardSet, err error) {
+	s = &ShardSet{maps: make(map[string]*ConnectionMap)}
+	for _, b := range blocks {
+		addr := net.JoinHostPort(b.Host, strconv.Itoa(b.Port))
+		cm := NewConnectionMap(addr, b.Password, timeouts)
+		if err = cm.PopulateConnections(); err != nil {
+			err = fmt.Errorf("Could not connect to shard %s: %s", b.Name, err)
+			return
+		}
+		println("Found shard", b.Name, "at", addr)
+		s.add(b.Name, cm)
+	}
+	return
+}
+
+func (s *ShardSet) add(name string, cm *ConnectionMap) {
+	s.names = append(s.names, name)
+	s.maps[name] = cm
+	for i := 0; i < ShardVirtualNodes; i++ {
+		h := crc32.ChecksumIEEE([]byte(fmt.Sprintf("%s#%d", name, i)))
+		s.ring = append(s.ring, ringPoint{hash: h, shard: name})
+	}
+	sort.Slice(s.ring, func(i, j int) bool {
+		return s.ring[i].hash < s.ring[j].hash
+	})
+	return
+}
+
+// Returns the name of the shard a key lives on. Keys with the same hash tag,
+// e.g. "{user:1}:profile" and "{user:1}:sessions", always share a shard.
+//
+func (s *ShardSet) Owner(key string) (name string) {
+	h := crc32.ChecksumIEEE([]byte(HashTag(key)))
+	i := sort.Search(len(s.ring), func(i int) bool {
+		return s.ring[i].hash >= h
+	})
+	if i == len(s.ring) {
+		i = 0
+	}
+	name = s.ring[i].shard
+	return
+}
+
+// Returns the database numbers that hold data on any of the shards.
+//
+func (s *ShardSet) Databases() (dbs []int) {
+	seen := make(map[int]bool)
+	for _, name := range s.names {
+		for _, db := range s.maps[name].NConnections() {
+			if !seen[db] {
+				seen[db] = true
+				dbs = append(dbs, db)
+			}
+		}
+	}
+	sort.Ints(dbs)
+	return
+}
+
+// Returns a client for a database that sends each command to the shard
+// owning its key, using the shards' shared connections.
+//
+func (s *ShardSet) Conn(db int) redis.Conn {
+	return &routedConn{router: shardRouter{set: s, db: db}}
+}
+
+// Like Conn, but over connections of its own, whose read timeouts are
+// extended by wait for blocking commands. Closing it closes them.
+//
+func (s *ShardSet) DedicatedConn(db int, wait time.Duration) redis.Conn {
+	return &routedConn{router: shardRouter{set: s, db: db}, own: make(map[string]redis.Conn), wait: wait}
+}
+
+// A shardRouter routes commands for one database across the shards.
+//
+type shardRouter struct {
+	set *ShardSet
+	db  int
+}
+
+func (r shardRouter) NodeFor(key string) string {
+	return r.set.Owner(key)
+}
+
+func (r shardRouter) Nodes() []string {
+	return r.set.names
+}
+
+func (r shardRouter) node(name string) (redis.Conn, error) {
+	return r.set.maps[name].DB(r.db)
+}
+
+func (r shardRouter) dial(name string, wait time.Duration) (redis.Conn, error) {
+	return r.set.maps[name].DialBlocking(r.db, wait)
+}
+
+// Walks every key on every shard, and moves the ones that belong somewhere
+// else to the shard that owns them, with MIGRATE. Run this after adding a
+// shard to the configuration.
+//
+// If the owning shard already has a key by that name, it was written after
+// the shard was added, so it is kept, and the old copy is deleted.
+//
+func (s *ShardSet) Rebalance() (moved, stale int, err error) {
+	for _, name := range s.names {
+		cm := s.maps[name]
+		for _, db := range cm.NConnections() {
+			var m, st int
+			m, st, err = s.rebalanceDB(name, cm, db)
+			moved, stale = moved+m, stale+st
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (s *ShardSet) rebalanceDB(name string, cm *ConnectionMap, db int) (moved, stale int, err error) {
+	conn, err := cm.Dial(db)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	cursor := "0"
+	for {
+		var reply []interface{}
+		if reply, err = redis.Values(conn.Do("SCAN", cursor, "COUNT", 1000)); err != nil {
+			return
+		}
+		if len(reply) != 2 {
+			err = errors.New("Unexpected reply to SCAN")
+			return
+		}
+		cursor, _ = redis.String(reply[0], nil)
+		keys, _ := redis.Strings(reply[1], nil)
+
+		for _, key := range keys {
+			owner := s.Owner(key)
+			if owner == name {
+				continue
+			}
+			target := s.maps[owner]
+			host, port, _ := net.SplitHostPort(target.Addr())
+			args := redis.Args{}.Add(host, port, key, db, 5000)
+			if len(target.password) > 0 {
+				args = args.Add("AUTH", target.password)
+			}
+
+			_, err = conn.Do("MIGRATE", args...)
+			if e, ok := err.(redis.Error); ok && strings.HasPrefix(string(e), "BUSYKEY") {
+				if _, err = conn.Do("DEL", key); err != nil {
+					return
+				}
+				println("REBALANCE", "dropped stale copy of", key, "from", name)
+				stale++
+				continue
+			}
+			if err != nil {
+				err = fmt.Errorf("Could not move %s from %s to %s: %s", key, name, owner, err)
+				return
+			}
+			println("REBALANCE", "moved", key, "from", name, "to", owner)
+			moved++
+		}
+
+		if cursor == "0" {
+			return
+		}
+	}
+}
@@ -0,0 +1,311 @@
+// stream.go
+//
+// Streams large collections to the client, a batch at a time, instead of
+// reading them into memory in one go.
+//
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The commands used to find out how many elements a collection holds.
+//
+var lengthCommands = map[string]string{
+	"list": "LLEN",
+	"set":  "SCARD",
+	"zset": "ZCARD",
+	"hash": "HLEN",
+}
+
+// Streams the value of a list, set, sorted set or hash to the client, if the
+// client asked for it with "stream=true", or the collection is larger than
+// the configured threshold. Returns false, without writing anything, if the
+// value should be read the usual way instead.
+//
+// Lists are read in LRANGE windows, and sets, sorted sets and hashes are
+// iterated with SSCAN, ZSCAN and HSCAN. This means sorted set members do not
+// come back in rank order, and, as with any SCAN, an element may be sent more
+// than once if the key is modified while it is being streamed.
+//
+// As with buffered reads, every value (and hash field name) is base64-encoded
+// if the client asked for "encoding=base64", or any of them is not valid
+// UTF-8. Since the encoding is sent in a header before the values, finding
+// that out takes a first pass over the collection; clients storing binary
+// data can skip it by asking for "encoding=base64" up front. If a value that
+// isn't valid UTF-8 shows up between the two passes, the stream stops with an
+// error rather than mangle it.
+//
+func StreamReadOperation(rw http.ResponseWriter, req *http.Request, info *RequestInfo) (streamed bool) {
+	if len(info.Key) == 0 || len(req.FormValue("field")) > 0 || req.FormValue("geo") == "true" {
+		return
+	}
+
+	format, err := NegotiateFormat(req)
+	if err != nil || (format != FormatJSON && format != FormatNDJSON && format != FormatCSV) {
+		return
+	}
+
+	client, err := info.DB()
+	if err != nil {
+		return
+	}
+	keyType, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		return
+	}
+	lengthCmd, ok := lengthCommands[keyType]
+	if !ok {
+		return
+	}
+
+	threshold, batch := config.HTTP.StreamLimits()
+	if req.FormValue("stream") != "true" {
+		if threshold < 0 {
+			return
+		}
+		n, err := redis.Int(client.Do(lengthCmd, info.Key))
+		if err != nil || n <= threshold {
+			return
+		}
+	}
+
+	encoding := EncodingUTF8
+	if req.FormValue("encoding") == EncodingBase64 {
+		encoding = EncodingBase64
+	} else {
+		err = walkCollection(client, keyType, info.Key, batch, func(value, field string) error {
+			if !utf8.ValidString(value) || !utf8.ValidString(field) {
+				return errNotUTF8
+			}
+			return nil
+		}, func() {})
+		if err == errNotUTF8 {
+			encoding = EncodingBase64
+		}
+	}
+
+	w := newStreamWriter(rw, format, encoding, keyType == "hash")
+	println("STREAM", keyType, info.Key)
+	err = walkCollection(client, keyType, info.Key, batch, w.element, w.flush)
+	w.end(err)
+	streamed = true
+	return
+}
+
+var errNotUTF8 = errors.New("A value that is not valid UTF-8 was added while streaming; ask for encoding=base64.")
+
+// Calls each for every element of a list, set, sorted set or hash, a batch
+// at a time, and flush after every batch. For hashes, each is given the
+// field's value and name; otherwise, the field is empty.
+//
+func walkCollection(client redis.Conn, keyType, key string, batch int, each func(value, field string) error, flush func()) (err error) {
+	switch keyType {
+	case "list":
+		err = streamList(client, key, batch, each, flush)
+	case "set":
+		err = streamScan(client, "SSCAN", key, batch, 1, each, flush)
+	case "zset":
+		err = streamScan(client, "ZSCAN", key, batch, 2, each, flush)
+	case "hash":
+		err = streamScan(client, "HSCAN", key, batch, 2, each, flush)
+	}
+	return
+}
+
+func streamList(client redis.Conn, key string, batch int, each func(value, field string) error, flush func()) (err error) {
+	for start := 0; ; start += batch {
+		var values []string
+		values, err = redis.Strings(client.Do("LRANGE", key, start, start+batch-1))
+		if err != nil {
+			return
+		}
+		for _, v := range values {
+			if err = each(v, ""); err != nil {
+				return
+			}
+		}
+		flush()
+		if len(values) < batch {
+			return
+		}
+	}
+}
+
+// Iterates over a key with one of the *SCAN commands. Each element of a
+// reply is stride values long: members for SSCAN, member/score pairs for
+// ZSCAN, and field/value pairs for HSCAN.
+//
+func streamScan(client redis.Conn, cmd, key string, batch, stride int, each func(value, field string) error, flush func()) (err error) {
+	cursor := "0"
+	for {
+		var reply []interface{}
+		reply, err = redis.Values(client.Do(cmd, key, cursor, "COUNT", batch))
+		if err != nil {
+			return
+		}
+		if len(reply) != 2 {
+			err = fmt.Errorf("Unexpected reply to %s", cmd)
+			return
+		}
+		if cursor, err = redis.String(reply[0], nil); err != nil {
+			return
+		}
+		var values []string
+		if values, err = redis.Strings(reply[1], nil); err != nil {
+			return
+		}
+
+		for i := 0; i+stride-1 < len(values); i += stride {
+			if cmd == "HSCAN" {
+				err = each(values[i+1], values[i])
+			} else {
+				err = each(values[i], "")
+			}
+			if err != nil {
+				return
+			}
+		}
+		flush()
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// Writes the elements of a collection to the client as they are read, in
+// the same shape the buffered encoders in format.go would have produced.
+//
+type streamWriter struct {
+	rw       http.ResponseWriter
+	format   string
+	encoding string
+	hash     bool
+	n        int
+	csv      *csv.Writer
+	err      error
+}
+
+func newStreamWriter(rw http.ResponseWriter, format, encoding string, hash bool) (w *streamWriter) {
+	w = &streamWriter{rw: rw, format: format, hash: hash, encoding: encoding}
+
+	rw.Header().Set("Content-Type", contentTypes[format])
+	rw.Header().Set("X-Scarlet-Encoding", w.encoding)
+	rw.Header().Set("X-Scarlet-Streamed", "true")
+	rw.WriteHeader(http.StatusOK)
+
+	switch format {
+	case FormatCSV:
+		w.csv = csv.NewWriter(rw)
+	case FormatJSON:
+		if hash {
+			w.write(`{"result":{`)
+		} else {
+			w.write(`{"result":[`)
+		}
+	}
+	return
+}
+
+func (w *streamWriter) write(s string) error {
+	if w.err == nil {
+		_, w.err = w.rw.Write([]byte(s))
+	}
+	return w.err
+}
+
+func (w *streamWriter) encode(s string) string {
+	if w.encoding == EncodingBase64 {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+	return s
+}
+
+// Writes one element of the collection. For hashes, field is the name of the
+// field the value belongs to.
+//
+func (w *streamWriter) element(value, field string) error {
+	if w.encoding == EncodingUTF8 && (!utf8.ValidString(value) || !utf8.ValidString(field)) {
+		return errNotUTF8
+	}
+	value = w.encode(value)
+	if w.hash {
+		field = w.encode(field)
+	}
+
+	switch w.format {
+	case FormatCSV:
+		record := []string{value}
+		if w.hash {
+			record = []string{field, value}
+		}
+		if w.err == nil {
+			w.err = w.csv.Write(record)
+		}
+
+	case FormatNDJSON:
+		var line interface{} = value
+		if w.hash {
+			line = R{"key": field, "value": value}
+		}
+		b, _ := json.Marshal(line)
+		w.write(string(b) + "\n")
+
+	default:
+		if w.n > 0 {
+			w.write(",")
+		}
+		v, _ := json.Marshal(value)
+		if w.hash {
+			k, _ := json.Marshal(field)
+			w.write(string(k) + ":")
+		}
+		w.write(string(v))
+	}
+	w.n++
+	return w.err
+}
+
+// Pushes everything written so far out to the client.
+//
+func (w *streamWriter) flush() {
+	if w.csv != nil {
+		w.csv.Flush()
+	}
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Finishes the response. Errors that happen part-way through can only be
+// reported in JSON responses, where they end up in the "error" field; for the
+// other formats, the stream just stops.
+//
+func (w *streamWriter) end(err error) {
+	if w.format == FormatJSON {
+		if w.hash {
+			w.write("}")
+		} else {
+			w.write("]")
+		}
+		var e interface{}
+		if err != nil {
+			e = fmt.Sprintf("%s", err)
+		}
+		b, _ := json.Marshal(e)
+		w.write(`,"count":` + strconv.Itoa(w.n) + `,"encoding":"` + w.encoding + `","error":` + string(b) + "}")
+	}
+	if err != nil {
+		println("STREAM", "error:", err.Error())
+	}
+	w.flush()
+	return
+}
@@ -0,0 +1,167 @@
+// tenant.go
+//
+// Tenants share a Redis host, but each one only sees its own keys: every key
+// name is transparently prefixed on the way in, and the prefix is stripped
+// from key names on the way out.
+//
+package main
+
+import (
+	"errors"
+	"github.com/garyburd/redigo/redis"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var errTenantCommand = errors.New("This command is not available to tenants")
+
+// Returns the tenant a request belongs to: the one holding the request's API
+// key, or failing that, the one serving the request's Host. Returns nil if
+// neither matches.
+//
+func TenantFor(req *http.Request) (tenant *TenantBlock) {
+	tenants := config.Tenants
+	if key := APIKey(req); len(key) > 0 {
+		for i := range tenants {
+			for _, k := range tenants[i].APIKeys {
+				if k == key {
+					tenant = &tenants[i]
+					return
+				}
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	for i := range tenants {
+		for _, h := range tenants[i].Hosts {
+			if strings.EqualFold(h, host) {
+				tenant = &tenants[i]
+				return
+			}
+		}
+	}
+	return
+}
+
+// Checks that a request belongs to a tenant, when the configuration says
+// every request must; by default, that's whenever there are tenants.
+//
+func CheckTenant(info *RequestInfo) (response R, denied bool) {
+	if info.Tenant == nil && config.TenantRequired() {
+		e := "This request does not belong to any tenant."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusForbidden)
+		denied = true
+	}
+	return
+}
+
+// A tenantConn wraps a Redis connection, prefixing every key name (and
+// channel name) it is given with the tenant's prefix, and stripping it from
+// any key names that come back. Listing keys with KEYS or SCAN only ever
+// turns up the tenant's own keys.
+//
+type tenantConn struct {
+	redis.Conn
+	prefix string
+}
+
+func (c tenantConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	// Work on a copy, so the caller's arguments aren't changed under it.
+	//
+	args = append([]interface{}{}, args...)
+
+	switch strings.ToUpper(cmd) {
+	case "KEYS":
+		pattern := "*"
+		if len(args) > 0 {
+			pattern = argString(args[0])
+		}
+		reply, err = c.Conn.Do(cmd, c.pattern(pattern))
+		reply = c.stripAll(reply)
+		return
+
+	case "SCAN":
+		// SCAN cursor [MATCH pattern] [COUNT count] ...
+		//
+		matched := false
+		for i := 1; i+1 < len(args); i += 2 {
+			if strings.ToUpper(argString(args[i])) == "MATCH" {
+				args[i+1] = c.pattern(argString(args[i+1]))
+				matched = true
+			}
+		}
+		if !matched {
+			args = append(args, "MATCH", c.pattern("*"))
+		}
+		var r []interface{}
+		if r, err = redis.Values(c.Conn.Do(cmd, args...)); err != nil || len(r) != 2 {
+			return
+		}
+		reply = []interface{}{r[0], c.stripAll(r[1])}
+		return
+
+	case "RANDOMKEY", "DBSIZE", "FLUSHDB", "FLUSHALL", "SWAPDB":
+		// These would let one tenant see, or touch, everybody's keys.
+		//
+		err = errTenantCommand
+		return
+
+	case "PUBLISH":
+		if len(args) > 0 {
+			args[0] = c.prefix + argString(args[0])
+		}
+	}
+
+	for _, i := range CommandKeys(cmd, args) {
+		args[i] = c.prefix + argString(args[i])
+	}
+	reply, err = c.Conn.Do(cmd, args...)
+
+	// Blocking pops reply with the name of the key they popped from.
+	//
+	if blockingCommands[strings.ToUpper(cmd)] {
+		if r, ok := reply.([]interface{}); ok && len(r) > 0 {
+			r[0] = c.strip(r[0])
+		}
+	}
+	return
+}
+
+// Turns a KEYS/SCAN pattern into one that only matches the tenant's keys.
+//
+func (c tenantConn) pattern(p string) string {
+	var escaped strings.Builder
+	for _, r := range c.prefix {
+		if strings.ContainsRune(`*?[]\`, r) {
+			escaped.WriteRune('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String() + p
+}
+
+func (c tenantConn) strip(key interface{}) interface{} {
+	switch k := key.(type) {
+	case []byte:
+		return []byte(strings.TrimPrefix(string(k), c.prefix))
+	case string:
+		return strings.TrimPrefix(k, c.prefix)
+	}
+	return key
+}
+
+func (c tenantConn) stripAll(reply interface{}) interface{} {
+	keys, ok := reply.([]interface{})
+	if !ok {
+		return reply
+	}
+	for i := range keys {
+		keys[i] = c.strip(keys[i])
+	}
+	return keys
+}
@@ -0,0 +1,96 @@
+// timeout.go
+//
+// Per-request deadlines, and giving up on work when a request's context is
+// cancelled.
+//
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"net/http"
+	"time"
+)
+
+// The header clients can use to ask for a deadline other than the configured
+// default, e.g. "X-Scarlet-Timeout: 2s".
+//
+const TimeoutHeader = "X-Scarlet-Timeout"
+
+// Returns how long the request may take. A deadline asked for through the
+// X-Scarlet-Timeout header is capped at the configured maximum.
+//
+func RequestDeadline(req *http.Request) (timeout time.Duration, err error) {
+	timeout, max := config.HTTP.RequestTimeouts()
+	if h := req.Header.Get(TimeoutHeader); len(h) > 0 {
+		if timeout, err = time.ParseDuration(h); err != nil || timeout <= 0 {
+			err = fmt.Errorf("Invalid %s header: %q", TimeoutHeader, h)
+			return
+		}
+	}
+	if timeout > max {
+		timeout = max
+	}
+	return
+}
+
+// Runs a request handler in its own goroutine, and waits for it to finish,
+// or for the request's context to be done, whichever comes first. When the
+// deadline passes, the client gets a 504.
+//
+// The handler can't be stopped in the middle of a Redis call, but since the
+// connection it got from RequestInfo.DB refuses to run any more commands
+// once the context is done, it will give up at the next one.
+//
+// A write already sent to Redis may still be applied after the deadline, so
+// for writes, the handler is always waited for: if it finishes anyway, the
+// client gets its response, however late, and otherwise, a 504 that says
+// the request may have been partly applied.
+//
+func RunWithDeadline(req *http.Request, write bool, handler func() R) (response R) {
+	done := make(chan R, 1)
+	go func() {
+		done <- handler()
+	}()
+
+	ctx := req.Context()
+	select {
+	case response = <-done:
+		return
+	case <-ctx.Done():
+	}
+
+	if ctx.Err() != context.DeadlineExceeded {
+		// The client went away; there's nobody left to tell.
+		//
+		response = R{"result": nil, "error": "Request cancelled."}
+		return
+	}
+	println("TIMEOUT", req.Method, req.URL.Path)
+	e := "Request timed out."
+	if write {
+		if response = <-done; response["error"] == nil {
+			return
+		}
+		e = "Request timed out; it may have been partly applied."
+	}
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusGatewayTimeout)
+	return
+}
+
+// A contextConn wraps a Redis connection, refusing to issue new commands
+// once its context is done.
+//
+type contextConn struct {
+	redis.Conn
+	ctx context.Context
+}
+
+func (c contextConn) Do(cmd string, args ...interface{}) (reply interface{}, err error) {
+	if err = c.ctx.Err(); err != nil {
+		return
+	}
+	reply, err = c.Conn.Do(cmd, args...)
+	return
+}
@@ -3,132 +3,193 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
 )
 
-// Handles HTTP PUT requests, inteded for updating keys.
+// Handles HTTP PUT requests, intended for updating keys.
+//
+// A PUT replaces the whole value of the key, atomically: the old value is
+// deleted and the new one written in a single transaction. Strings take the
+// usual value; lists and sets take a JSON array (or several "value"
+// parameters), sorted sets a JSON object of members and their scores, and
+// hashes a JSON object of fields and values. The "type" parameter changes
+// the type of the key. As with SET, any expiry is cleared, unless a new one
+// is given with "ttl".
 //
 func HandleUpdateOperation(req *http.Request, info *RequestInfo) (response R) {
-	client, err := Database.DB(info.DbNum)
-	v, err := client.Do("EXISTS", info.Key)
+	client, err := info.DedicatedDB()
 	if err != nil {
 		response = R{"result": nil, "error": fmt.Sprintf("%s", err)}
 		return
 	}
-	existsp, ok := v.(bool)
-	if ok && existsp {
-		var errors []string
+	defer client.Close()
 
-		// Check if the user specfieid an expiry time for the key.
-		//
-		if ttl := req.FormValue("ttl"); len(ttl) > 0 {
-			ittl, err := strconv.Atoi(ttl)
-			if err != nil {
-				errors = append(errors, fmt.Sprintf("%s", err))
-			}
-
-			v, err := client.Do("EXPIRE", info.Key, int64(ittl))
-			if err != nil {
-				errors = append(errors, fmt.Sprintf("%s", err))
-			}
-
-			setp, ok := v.(bool)
-			if ok && setp {
-				fmt.Println("EXPIRE", info.Key, ittl)
-			}
+	keytype, err := redis.String(client.Do("TYPE", info.Key))
+	if err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	if keytype == "none" {
+		e := "Key does not exist, cannot update."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusNotFound)
+		return
+	}
+	if t := req.FormValue("type"); len(t) > 0 {
+		if _, ok := elementCommands[t]; !ok && t != "string" {
+			response = R{"result": nil, "error": "Invalid key type."}.WithStatus(http.StatusBadRequest)
+			return
 		}
+		keytype = t
+	}
 
-		// Get the value the user would like to set.
-		//
-		val := req.FormValue("value")
-		fmt.Println("DEBUG", "Value =", val)
+	var ttl int64
+	if t := req.FormValue("ttl"); len(t) > 0 {
+		if ttl, err = strconv.ParseInt(t, 10, 64); err != nil || ttl <= 0 {
+			e := "The \"ttl\" parameter must be a positive number of seconds."
+			response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+			return
+		}
+	}
 
-		// Now we need to branch, depending on the type of key we are setting
-		// to.
-		//
-		v, err := client.Do("TYPE", info.Key)
+	commands := [][]interface{}{{"DEL", info.Key}}
+	if keytype == "string" {
+		value, err := RequestValue(req)
 		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s", err))
+			response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+			return
 		}
-
-		keytype, ok := v.(string)
-		if !ok {
-			msg := "Could not convert reply to string."
-			response = R{"result": nil, "error": msg}
+		if response = ValidateValue(info.Key, value); response != nil {
 			return
 		}
-		switch keytype {
-		case "string":
-			if offset := req.FormValue("offset"); len(offset) > 0 {
-				i, err := strconv.Atoi(offset)
-				if err != nil {
-					errors = append(errors, fmt.Sprintf("%s", err))
-				} else {
-					_, err = client.Do("SETRANGE", info.Key, i, val)
-					fmt.Println("SETRANGE", info.Key, i, val)
-				}
-			}
-			_, err = client.Do("SET", info.Key, val)
-			fmt.Println("SET", info.Key, val)
+		commands = append(commands, []interface{}{"SET", info.Key, value})
+	} else {
+		var elements []interface{}
+		if elements, response = RequestElements(req, keytype); response != nil {
+			return
+		}
+		if len(elements) > 0 {
+			cmd := append([]interface{}{elementCommands[keytype], info.Key}, elements...)
+			commands = append(commands, cmd)
+		}
+	}
+	if ttl > 0 {
+		commands = append(commands, []interface{}{"EXPIRE", info.Key, ttl})
+	}
+
+	fmt.Println("REPLACE", info.Key, keytype)
+	if _, err = transaction(client, commands); err != nil {
+		response = ErrorResponse(err)
+		return
+	}
+	response = R{"result": true, "error": nil}
+	return
+}
 
-		case "set":
-			_, err = client.Do("SADD", info.Key, val)
-			fmt.Println("SADD", info.Key, val)
+// The commands that add elements to each type of collection.
+//
+var elementCommands = map[string]string{
+	"hash": "HSET",
+	"list": "RPUSH",
+	"set":  "SADD",
+	"zset": "ZADD",
+}
 
-		case "zset":
-			var ranking float64 = 1.0
-			if v := req.FormValue("ranking"); len(v) > 0 {
-				f, err := strconv.ParseFloat(v, 64)
-				if err != nil {
-					errors = append(errors, fmt.Sprintf("%s", err))
-				} else {
-					ranking = f
-				}
-			}
-			_, err = client.Do("ZADD", info.Key, ranking, val)
-			fmt.Println("ZADD", info.Key, ranking, val)
+// Returns true if the request body is JSON (including JSON Merge Patch and
+// JSON Patch documents).
+//
+func isJSON(req *http.Request) bool {
+	ct, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return ct == "application/json" || strings.HasSuffix(ct, "+json")
+}
 
-		case "hash":
-			field := req.FormValue("field")
-			if len(field) == 0 {
-				e := "Missing required parameter: field."
-				response = R{"result": nil, "error": e}
+// Returns the elements a request writes to a collection, as the arguments
+// that follow the key in the command from elementCommands: values for lists
+// and sets, score-member pairs for sorted sets, and field-value pairs for
+// hashes.
+//
+// Lists and sets take a JSON array, or several "value" parameters. Sorted
+// sets take a JSON object mapping members to scores, and hashes one mapping
+// fields to values. Values that aren't JSON strings are stored as JSON.
+//
+func RequestElements(req *http.Request, keytype string) (elements []interface{}, response R) {
+	if !isJSON(req) {
+		if keytype == "list" || keytype == "set" {
+			values, err := RequestValues(req)
+			if err != nil {
+				response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
 				return
 			}
-			_, err = client.Do("HSET", info.Key, field, val)
-			fmt.Println("HSET", info.Key, field, val)
-
-		case "list":
-			side := "right"
-			if req.FormValue("side") == "left" {
-				side = "left"
+			for _, v := range values {
+				elements = append(elements, v)
 			}
+			return
+		}
+		e := fmt.Sprintf("A %s must be given as a JSON object.", keytype)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusUnsupportedMediaType)
+		return
+	}
 
-			if side == "left" {
-				_, err = client.Do("LPUSH", info.Key, val)
-				fmt.Println("LPUSH", info.Key, val)
-			} else {
-				_, err = client.Do("RPUSH", info.Key, val)
-				fmt.Println("RPUSH", info.Key, val)
+	var body interface{}
+	if err := decodeJSON(req.Body, &body); err != nil {
+		e := fmt.Sprintf("Could not decode the request body: %s", err)
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+		return
+	}
+
+	switch b := body.(type) {
+	case []interface{}:
+		if keytype != "list" && keytype != "set" {
+			break
+		}
+		for _, v := range b {
+			s, err := fieldValue(v)
+			if err != nil {
+				response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+				return
 			}
+			elements = append(elements, s)
 		}
+		return
 
-		if err != nil {
-			errors = append(errors, fmt.Sprintf("%s", err))
+	case map[string]interface{}:
+		if keytype != "zset" && keytype != "hash" {
+			break
 		}
-
-		if len(errors) > 0 {
-			response = R{"result": nil, "error": strings.Join(errors, " ")}
-		} else {
-			response = R{"result": true, "error": nil}
+		for _, name := range sortedKeys(b) {
+			if keytype == "zset" {
+				// The score is passed on as it was written, so Redis
+				// parses it with its own precision.
+				//
+				score, ok := b[name].(json.Number)
+				if _, err := strconv.ParseFloat(string(score), 64); !ok || err != nil {
+					e := fmt.Sprintf("The score for %s must be a number.", name)
+					response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
+					return
+				}
+				elements = append(elements, string(score), name)
+				continue
+			}
+			s, err := fieldValue(b[name])
+			if err != nil {
+				response = R{"result": nil, "error": fmt.Sprintf("%s", err)}.WithStatus(http.StatusBadRequest)
+				return
+			}
+			elements = append(elements, name, s)
 		}
-	} else {
-		e := "Key does not exist, cannot update."
-		response = R{"result": nil, "error": e}
 		return
 	}
+
+	kind := "a JSON array"
+	if keytype == "zset" || keytype == "hash" {
+		kind = "a JSON object"
+	}
+	e := fmt.Sprintf("A %s must be given as %s.", keytype, kind)
+	response = R{"result": nil, "error": e}.WithStatus(http.StatusBadRequest)
 	return
 }
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRequestElements(t *testing.T) {
+	tests := []struct {
+		keytype  string
+		body     string
+		elements []interface{}
+	}{
+		{"list", `["a", 12345678901234567891, {"n": 1.0}]`, []interface{}{"a", "12345678901234567891", `{"n":1.0}`}},
+		{"set", `[1e3]`, []interface{}{"1e3"}},
+		{"hash", `{"id": 12345678901234567891, "name": "x"}`, []interface{}{"id", "12345678901234567891", "name", "x"}},
+		{"zset", `{"a": 12345678901234567891, "b": 0.5}`, []interface{}{"12345678901234567891", "a", "0.5", "b"}},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("PUT", "/0/k", strings.NewReader(test.body))
+		req.Header.Set("Content-Type", "application/json")
+		elements, response := RequestElements(req, test.keytype)
+		if response != nil {
+			t.Errorf("RequestElements(%s, %s) failed: %v", test.keytype, test.body, response["error"])
+			continue
+		}
+		if !reflect.DeepEqual(elements, test.elements) {
+			t.Errorf("RequestElements(%s, %s) = %q, want %q", test.keytype, test.body, elements, test.elements)
+		}
+	}
+
+	for _, body := range []string{`{"a": "1"}`, `{"a": 1} {"b": 2}`, `{"a": 1}]`} {
+		req, _ := http.NewRequest("PUT", "/0/k", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if elements, response := RequestElements(req, "zset"); response == nil {
+			t.Errorf("RequestElements(zset, %s) = %q, want an error", body, elements)
+		}
+	}
+}
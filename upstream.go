@@ -0,0 +1,82 @@
+// upstream.go
+//
+// Named upstreams: additional Redis hosts, each with its own connections,
+// credentials, ACL and settings, addressed as /{upstream}/{db}/{key}.
+//
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+var (
+	// Upstream names start with a letter, so they can't be confused with
+	// database numbers.
+	//
+	UpstreamNameRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*$`)
+
+	// The connections to the named upstreams. The default upstream is
+	// Database.
+	//
+	Upstreams = make(map[string]*ConnectionMap)
+)
+
+// Connects to every named upstream in the configuration.
+//
+func ConnectUpstreams(blocks map[string]RedisBlock) (err error) {
+	for name, block := range blocks {
+		var cm *ConnectionMap
+		if cm, err = NewUpstream(block); err != nil {
+			err = fmt.Errorf("Could not connect to upstream %s: %s", name, err)
+			return
+		}
+		println("Connected to upstream", name)
+		Upstreams[name] = cm
+	}
+	return
+}
+
+// Returns the connections and settings for an upstream. The empty name is
+// the default upstream.
+//
+func Upstream(name string) (cm *ConnectionMap, block RedisBlock, ok bool) {
+	if len(name) == 0 {
+		cm, block, ok = Database, config.Redis, true
+		return
+	}
+	cm, ok = Upstreams[name]
+	block = config.Upstreams[name]
+	return
+}
+
+// Checks the request's API key against the upstream's ACL. Upstreams without
+// an ACL are open to everyone. write says whether the request writes.
+//
+func CheckACL(req *http.Request, upstream string, write bool) (response R, denied bool) {
+	_, block, _ := Upstream(upstream)
+	if len(block.ACL) == 0 {
+		return
+	}
+
+	key := APIKey(req)
+	access, ok := block.ACL[key]
+	switch {
+	case len(key) == 0:
+		e := "An API key is required."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusUnauthorized)
+		denied = true
+
+	case !ok:
+		e := "This API key does not have access to this upstream."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusForbidden)
+		denied = true
+
+	case access == AccessRead && write:
+		e := "This API key only has read access to this upstream."
+		response = R{"result": nil, "error": e}.WithStatus(http.StatusForbidden)
+		denied = true
+	}
+	return
+}
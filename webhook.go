@@ -0,0 +1,431 @@
+// webhook.go
+//
+// Webhooks for keyspace notifications. Scarlet subscribes to the
+// __keyspace@N__ channels of the databases the configured webhooks watch,
+// and POSTs every event that matches a webhook's key patterns and event
+// types to its URL, as JSON:
+//
+//	{"id": "...", "webhook": "cache", "upstream": "", "database": 0,
+//	 "key": "user:1", "event": "set", "time": "2026-10-19T12:00:00Z"}
+//
+// When the webhook has a secret, the body is signed with HMAC-SHA256, and
+// the signature is sent as "X-Scarlet-Signature: sha256=<hex>". Failed
+// deliveries are retried with exponential backoff. The latest deliveries
+// (and failures) are kept in a log, shown at /_admin/webhooks.
+//
+// Keyspace notifications are only published by the server the key lives
+// on, so webhooks can't watch cluster or sharded upstreams.
+//
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/garyburd/redigo/redis"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultWebhookTimeout     = 5 * time.Second
+	DefaultWebhookMaxAttempts = 5
+
+	// Deliveries are retried after WebhookBackoff, doubling every time, up
+	// to WebhookMaxBackoff.
+	//
+	WebhookBackoff    = time.Second
+	WebhookMaxBackoff = time.Minute
+
+	// How many events may be waiting to be delivered to a webhook; events
+	// beyond that are dropped.
+	//
+	WebhookQueueSize = 1000
+
+	// How many deliveries the log keeps.
+	//
+	WebhookLogSize = 1000
+
+	// How long to wait before subscribing again, after a subscription fails.
+	//
+	WebhookRetryInterval = 2 * time.Second
+
+	WebhookSignatureHeader = "X-Scarlet-Signature"
+)
+
+type WebhookEvent struct {
+	Id       string    `json:"id"`
+	Webhook  string    `json:"webhook"`
+	Upstream string    `json:"upstream"`
+	Database int       `json:"database"`
+	Key      string    `json:"key"`
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+}
+
+type webhook struct {
+	WebhookBlock
+	keys    []*regexp.Regexp
+	events  map[string]bool
+	dbs     map[int]bool
+	timeout time.Duration
+	queue   chan WebhookEvent
+}
+
+var Webhooks []*webhook
+
+// Sets up the webhooks in the configuration: turns on keyspace
+// notifications on their upstreams (if the servers allow it), subscribes to
+// them, and starts delivering events.
+//
+func StartWebhooks(blocks []WebhookBlock) (err error) {
+	watched := make(map[string]map[int]bool)
+	for _, b := range blocks {
+		h := &webhook{
+			WebhookBlock: b,
+			events:       make(map[string]bool),
+			dbs:          make(map[int]bool),
+			queue:        make(chan WebhookEvent, WebhookQueueSize),
+		}
+		for _, k := range b.Keys {
+			var re *regexp.Regexp
+			if re, err = globRegexp(k); err != nil {
+				err = fmt.Errorf("Invalid key pattern %s for webhook %s: %s", k, b.Name, err)
+				return
+			}
+			h.keys = append(h.keys, re)
+		}
+		for _, e := range b.Events {
+			h.events[e] = true
+		}
+		if len(b.Databases) == 0 {
+			b.Databases = []int{0}
+		}
+		if watched[b.Upstream] == nil {
+			watched[b.Upstream] = make(map[int]bool)
+		}
+		for _, db := range b.Databases {
+			h.dbs[db] = true
+			watched[b.Upstream][db] = true
+		}
+		h.timeout, _ = parseDuration(b.Timeout, DefaultWebhookTimeout)
+		Webhooks = append(Webhooks, h)
+	}
+
+	for upstream, dbs := range watched {
+		cm, _, ok := Upstream(upstream)
+		if !ok {
+			err = fmt.Errorf("Unknown upstream for webhooks: %s", upstream)
+			return
+		}
+		if cm.cluster != nil || cm.shards != nil {
+			err = fmt.Errorf("Webhooks can't watch cluster or sharded upstreams")
+			return
+		}
+		if e := enableNotifications(cm); e != nil {
+			println("WEBHOOK", "could not enable keyspace notifications:", e.Error())
+			println("WEBHOOK", "set notify-keyspace-events to (at least) \"KA\" on", cm.Addr())
+		}
+		go watchKeyspace(cm, upstream, dbs)
+	}
+	for _, h := range Webhooks {
+		println("WEBHOOK", h.Name, "->", h.URL)
+		go h.deliver()
+	}
+	return
+}
+
+// Adds the "K" (keyspace events) and "A" (all event types) flags to the
+// server's notify-keyspace-events setting, keeping any flags already set.
+//
+func enableNotifications(cm *ConnectionMap) (err error) {
+	conn, err := cm.DialMaster(0)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	reply, err := redis.Strings(conn.Do("CONFIG", "GET", "notify-keyspace-events"))
+	if err != nil {
+		return
+	}
+	flags := ""
+	if len(reply) == 2 {
+		flags = reply[1]
+	}
+	updated := flags
+	for _, f := range []string{"K", "A"} {
+		if !strings.Contains(updated, f) {
+			updated += f
+		}
+	}
+	if updated != flags {
+		_, err = conn.Do("CONFIG", "SET", "notify-keyspace-events", updated)
+	}
+	return
+}
+
+// Subscribes to the keyspace notifications of an upstream's databases, and
+// hands the events to the webhooks. Subscriptions that fail are
+// re-established. This never returns; run it in its own goroutine.
+//
+func watchKeyspace(cm *ConnectionMap, upstream string, dbs map[int]bool) {
+	var patterns []interface{}
+	for db := range dbs {
+		patterns = append(patterns, fmt.Sprintf("__keyspace@%d__:*", db))
+	}
+	for {
+		if err := subscribeKeyspace(cm, upstream, patterns); err != nil {
+			println("WEBHOOK", "subscription error:", err.Error())
+		}
+		time.Sleep(WebhookRetryInterval)
+	}
+}
+
+func subscribeKeyspace(cm *ConnectionMap, upstream string, patterns []interface{}) (err error) {
+	c, err := cm.DialSubscriber()
+	if err != nil {
+		return
+	}
+	psc := redis.PubSubConn{Conn: c}
+	defer psc.Close()
+	if err = psc.PSubscribe(patterns...); err != nil {
+		return
+	}
+
+	for {
+		switch msg := psc.Receive().(type) {
+		case redis.PMessage:
+			// __keyspace@<db>__:<key>
+			//
+			channel := strings.TrimPrefix(msg.Channel, "__keyspace@")
+			i := strings.Index(channel, "__:")
+			if i < 0 {
+				continue
+			}
+			db, e := strconv.Atoi(channel[:i])
+			if e != nil {
+				continue
+			}
+			ev := WebhookEvent{
+				Upstream: upstream,
+				Database: db,
+				Key:      channel[i+3:],
+				Event:    string(msg.Data),
+				Time:     time.Now().UTC(),
+			}
+			for _, h := range Webhooks {
+				if h.Upstream == upstream && h.matches(ev) {
+					h.enqueue(ev)
+				}
+			}
+
+		case error:
+			err = msg
+			return
+		}
+	}
+}
+
+// Returns true if the webhook wants to hear about the event.
+//
+func (h *webhook) matches(ev WebhookEvent) bool {
+	if !h.dbs[ev.Database] || (len(h.events) > 0 && !h.events[ev.Event]) {
+		return false
+	}
+	if len(h.keys) == 0 {
+		return true
+	}
+	for _, re := range h.keys {
+		if re.MatchString(ev.Key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *webhook) enqueue(ev WebhookEvent) {
+	ev.Webhook = h.Name
+	ev.Id, _ = randomToken()
+	select {
+	case h.queue <- ev:
+	default:
+		DeliveryLog.Add(WebhookDelivery{Id: ev.Id, Webhook: h.Name, Key: ev.Key, Event: ev.Event,
+			Time: time.Now().UTC(), Error: "Dropped: too many events waiting to be delivered"})
+	}
+	return
+}
+
+// Delivers the webhook's events, one at a time, in the order they happened.
+// This never returns; run it in its own goroutine.
+//
+func (h *webhook) deliver() {
+	client := &http.Client{Timeout: h.timeout}
+	for ev := range h.queue {
+		h.send(client, ev)
+	}
+}
+
+// Sends an event to the webhook, retrying with exponential backoff until
+// it's accepted, or it's been tried maxAttempts times. Responses in the 4xx
+// range (other than 408 and 429) aren't retried.
+//
+func (h *webhook) send(client *http.Client, ev WebhookEvent) {
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	maxAttempts := h.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = DefaultWebhookMaxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		d := WebhookDelivery{Id: ev.Id, Webhook: h.Name, Key: ev.Key, Event: ev.Event, Attempt: attempt, Time: time.Now().UTC()}
+		d.Status, err = h.post(client, ev, body)
+		d.Duration = time.Since(d.Time).String()
+		if err != nil {
+			d.Error = err.Error()
+		}
+		DeliveryLog.Add(d)
+
+		done := err == nil && d.Status < 300
+		permanent := d.Status >= 400 && d.Status < 500 &&
+			d.Status != http.StatusRequestTimeout && d.Status != http.StatusTooManyRequests
+		if done || permanent || attempt >= maxAttempts {
+			if !done {
+				println("WEBHOOK", h.Name, "giving up on", ev.Id, "after", attempt, "attempts")
+			}
+			return
+		}
+		time.Sleep(webhookBackoff(attempt))
+	}
+}
+
+// Returns how long to wait after a failed attempt before the next one.
+//
+func webhookBackoff(attempt int) (backoff time.Duration) {
+	backoff = WebhookBackoff
+	for i := 1; i < attempt && backoff < WebhookMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > WebhookMaxBackoff {
+		backoff = WebhookMaxBackoff
+	}
+	return
+}
+
+func (h *webhook) post(client *http.Client, ev WebhookEvent, body []byte) (status int, err error) {
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Scarlet/"+Version)
+	req.Header.Set("X-Scarlet-Event", ev.Event)
+	req.Header.Set("X-Scarlet-Delivery", ev.Id)
+	if len(h.Secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+Signature(h.Secret, body))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	status = resp.StatusCode
+	if status >= 300 {
+		err = fmt.Errorf("Webhook responded with %s", resp.Status)
+	}
+	return
+}
+
+// Returns the hex-encoded HMAC-SHA256 of a body, for receivers to check that
+// it came from us.
+//
+func Signature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// One attempt at delivering an event to a webhook.
+//
+type WebhookDelivery struct {
+	Id       string    `json:"id"`
+	Webhook  string    `json:"webhook"`
+	Key      string    `json:"key"`
+	Event    string    `json:"event"`
+	Attempt  int       `json:"attempt"`
+	Status   int       `json:"status,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+// Keeps the latest WebhookLogSize deliveries, in memory.
+//
+type deliveryLog struct {
+	sync.Mutex
+	entries []WebhookDelivery
+	next    int
+}
+
+var DeliveryLog = &deliveryLog{}
+
+func (l *deliveryLog) Add(d WebhookDelivery) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.entries) < WebhookLogSize {
+		l.entries = append(l.entries, d)
+	} else {
+		l.entries[l.next] = d
+	}
+	l.next = (l.next + 1) % WebhookLogSize
+	return
+}
+
+// Returns the deliveries to a webhook (or to every webhook, if name is
+// empty), newest first.
+//
+func (l *deliveryLog) Entries(name string) (entries []WebhookDelivery) {
+	l.Lock()
+	defer l.Unlock()
+	entries = []WebhookDelivery{}
+	for i := 1; i <= len(l.entries); i++ {
+		d := l.entries[(l.next-i+len(l.entries))%len(l.entries)]
+		if len(name) == 0 || d.Webhook == name {
+			entries = append(entries, d)
+		}
+	}
+	return
+}
+
+// Shows the configured webhooks, how many events each has waiting, and the
+// delivery log; "webhook" narrows the log down to a single webhook.
+//
+func WebhooksHandler(rw http.ResponseWriter, req *http.Request) {
+	if response, denied := CheckAdmin(req); denied {
+		WriteResponse(rw, req, response)
+		return
+	}
+	if req.Method != "GET" {
+		e := "Method not allowed."
+		WriteResponse(rw, req, R{"result": nil, "error": e}.WithStatus(http.StatusMethodNotAllowed))
+		return
+	}
+	hooks := []R{}
+	for _, h := range Webhooks {
+		hooks = append(hooks, R{"name": h.Name, "url": h.URL, "pending": len(h.queue)})
+	}
+	result := R{"webhooks": hooks, "deliveries": DeliveryLog.Entries(req.FormValue("webhook"))}
+	WriteResponse(rw, req, R{"result": result, "error": nil})
+	return
+}
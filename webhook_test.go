@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookMatches(t *testing.T) {
+	h := &webhook{
+		dbs:    map[int]bool{0: true, 2: true},
+		events: map[string]bool{"set": true, "del": true},
+		keys:   []*regexp.Regexp{},
+	}
+	for _, k := range []string{"user:*", "session:?"} {
+		re, err := globRegexp(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.keys = append(h.keys, re)
+	}
+	tests := []struct {
+		ev      WebhookEvent
+		matches bool
+	}{
+		{WebhookEvent{Database: 0, Key: "user:1", Event: "set"}, true},
+		{WebhookEvent{Database: 2, Key: "session:a", Event: "del"}, true},
+		{WebhookEvent{Database: 1, Key: "user:1", Event: "set"}, false},
+		{WebhookEvent{Database: 0, Key: "user:1", Event: "expired"}, false},
+		{WebhookEvent{Database: 0, Key: "session:ab", Event: "set"}, false},
+		{WebhookEvent{Database: 0, Key: "account:1", Event: "set"}, false},
+	}
+	for _, test := range tests {
+		if m := h.matches(test.ev); m != test.matches {
+			t.Errorf("matches(%+v) = %v, want %v", test.ev, m, test.matches)
+		}
+	}
+
+	// Without events or keys, everything in the webhook's databases matches.
+	//
+	all := &webhook{dbs: map[int]bool{0: true}}
+	if !all.matches(WebhookEvent{Database: 0, Key: "anything", Event: "hset"}) {
+		t.Errorf("A webhook with no filters did not match an event in its database")
+	}
+	if all.matches(WebhookEvent{Database: 3, Key: "anything", Event: "hset"}) {
+		t.Errorf("A webhook matched an event in a database it doesn't watch")
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	l := &deliveryLog{}
+	for i := 1; i <= 3; i++ {
+		l.Add(WebhookDelivery{Webhook: "a", Attempt: i})
+	}
+	entries := l.Entries("")
+	if len(entries) != 3 || entries[0].Attempt != 3 || entries[2].Attempt != 1 {
+		t.Errorf("Entries() = %+v, want attempts 3, 2, 1", entries)
+	}
+
+	l = &deliveryLog{}
+	total := WebhookLogSize + 5
+	for i := 1; i <= total; i++ {
+		name := "a"
+		if i%2 == 0 {
+			name = "b"
+		}
+		l.Add(WebhookDelivery{Webhook: name, Attempt: i})
+	}
+	entries = l.Entries("")
+	if len(entries) != WebhookLogSize {
+		t.Fatalf("The log holds %d entries, want %d", len(entries), WebhookLogSize)
+	}
+	for i, d := range entries {
+		if want := total - i; d.Attempt != want {
+			t.Fatalf("Entry %d is attempt %d, want %d", i, d.Attempt, want)
+		}
+	}
+	for _, d := range l.Entries("b") {
+		if d.Webhook != "b" {
+			t.Fatalf("Entries(b) includes a delivery to %s", d.Webhook)
+		}
+	}
+	if n := len(l.Entries("b")); n != WebhookLogSize/2 {
+		t.Errorf("Entries(b) has %d entries, want %d", n, WebhookLogSize/2)
+	}
+	if n := len(l.Entries("c")); n != 0 {
+		t.Errorf("Entries(c) has %d entries, want none", n)
+	}
+}
+
+func TestSignature(t *testing.T) {
+	// RFC 4231, test case 2.
+	//
+	want := "5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+	if s := Signature("Jefe", []byte("what do ya want for nothing?")); s != want {
+		t.Errorf("Signature = %s, want %s", s, want)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempt int
+		backoff time.Duration
+	}{
+		{1, WebhookBackoff},
+		{2, 2 * WebhookBackoff},
+		{3, 4 * WebhookBackoff},
+		{7, WebhookMaxBackoff},
+		{100, WebhookMaxBackoff},
+	}
+	for _, test := range tests {
+		if b := webhookBackoff(test.attempt); b != test.backoff {
+			t.Errorf("webhookBackoff(%d) = %s, want %s", test.attempt, b, test.backoff)
+		}
+	}
+}
+
+// A receiver that answers with the given statuses in turn, repeating the
+// last one, and checks the signature of every delivery.
+//
+type testReceiver struct {
+	sync.Mutex
+	t        *testing.T
+	secret   string
+	statuses []int
+	requests int
+}
+
+func (r *testReceiver) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	if sig := req.Header.Get(WebhookSignatureHeader); sig != "sha256="+Signature(r.secret, body) {
+		r.t.Errorf("Bad signature %q", sig)
+	}
+	var ev WebhookEvent
+	if err := json.Unmarshal(body, &ev); err != nil || ev.Key != "user:1" {
+		r.t.Errorf("Bad event %s: %v", body, err)
+	}
+	r.Lock()
+	status := r.statuses[len(r.statuses)-1]
+	if r.requests < len(r.statuses) {
+		status = r.statuses[r.requests]
+	}
+	r.requests++
+	r.Unlock()
+	rw.WriteHeader(status)
+}
+
+func TestWebhookSend(t *testing.T) {
+	defer func(l *deliveryLog) { DeliveryLog = l }(DeliveryLog)
+
+	tests := []struct {
+		statuses []int
+		attempts int
+	}{
+		{[]int{http.StatusOK}, 1},
+		{[]int{http.StatusNoContent}, 1},
+		{[]int{http.StatusBadRequest}, 1},
+		{[]int{http.StatusNotFound}, 1},
+		{[]int{http.StatusGone}, 1},
+		{[]int{http.StatusInternalServerError}, 2},
+		{[]int{http.StatusRequestTimeout}, 2},
+		{[]int{http.StatusTooManyRequests, http.StatusOK}, 2},
+	}
+	for _, test := range tests {
+		DeliveryLog = &deliveryLog{}
+		receiver := &testReceiver{t: t, secret: "s3cret", statuses: test.statuses}
+		server := httptest.NewServer(receiver)
+		h := &webhook{WebhookBlock: WebhookBlock{Name: "hook", URL: server.URL, Secret: "s3cret", MaxAttempts: 2}}
+		h.send(server.Client(), WebhookEvent{Id: "1", Key: "user:1", Event: "set"})
+		server.Close()
+
+		if receiver.requests != test.attempts {
+			t.Errorf("Statuses %v: %d attempts, want %d", test.statuses, receiver.requests, test.attempts)
+		}
+		entries := DeliveryLog.Entries("hook")
+		if len(entries) != test.attempts {
+			t.Errorf("Statuses %v: %d deliveries logged, want %d", test.statuses, len(entries), test.attempts)
+			continue
+		}
+		last := entries[0]
+		if want := test.statuses[len(test.statuses)-1]; last.Status != want || last.Attempt != test.attempts {
+			t.Errorf("Statuses %v: last delivery was %+v", test.statuses, last)
+		}
+		if (last.Status >= 300) != (len(last.Error) > 0) {
+			t.Errorf("Statuses %v: last delivery has error %q", test.statuses, last.Error)
+		}
+	}
+}